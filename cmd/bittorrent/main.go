@@ -1,14 +1,76 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/BitTorrentFileSharing/bittorrent/internal/app"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
 )
 
+const usage = `usage: bittorrent <command> [flags] [args]
+
+commands:
+  create   build a .bit/.torrent file for a payload without seeding it
+  info     print what a metainfo file describes
+  verify   hash local data against a metainfo file
+  seed     seed payload files or directories
+  get      download from .bit/.torrent files or magnet links
+  dht      run a bare DHT node
+  daemon   keep running, controlled over a local HTTP API
+  ctl      talk to a running daemon
+
+Run 'bittorrent <command> -h' for the flags of a command.
+`
+
 func main() {
-	cfg := app.ParseFlags()
+	cmd, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "create":
+		exitOn(app.RunCreate(args))
+	case "info":
+		exitOn(app.RunInfo(args))
+	case "verify":
+		exitOn(app.RunVerify(args))
+	case "ctl":
+		exitOn(app.RunCtl(args))
+	case "daemon":
+		runDaemon(app.ParseFlags(cmd, args))
+	case "seed", "get", "dht", "":
+		// "" is the old flat form (-seed/-get flags), kept for existing scripts
+		if cmd == "" && len(args) == 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		run(app.ParseFlags(cmd, args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// One-shot commands print their error and exit 1
+func exitOn(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// Seeds, downloads or runs a DHT node, depending on what cfg asks for
+func run(cfg *app.Config) {
+	if cfg.NumTorrents() > 1 {
+		runManager(cfg)
+		return
+	}
 
 	// Create a "blank" session (no meta that depends on the mode)
 	sess, err := app.NewSession(cfg, nil)
@@ -17,6 +79,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Ctrl+C: flush pieces and leave a resume file behind
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Log("shutdown", map[string]any{"signal": sig.String()})
+		sess.Shutdown()
+		os.Exit(1)
+	}()
+
 	// Decide file-sharing role
 	switch {
 	case cfg.SeedPath != "":
@@ -36,3 +108,51 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Several -seed/-get: all torrents share one listener and one DHT node
+func runManager(cfg *app.Config) {
+	m := startManager(cfg)
+
+	logger.Log("role", map[string]any{"mode": "manager", "torrents": cfg.NumTorrents()})
+	for _, path := range cfg.SeedPaths {
+		if _, err := m.AddSeed(path); err != nil {
+			logger.Log("add_err", map[string]any{"path": path, "err": err.Error()})
+		}
+	}
+	for _, path := range cfg.MetaPaths {
+		if _, err := m.AddGet(path, ""); err != nil {
+			logger.Log("add_err", map[string]any{"path": path, "err": err.Error()})
+		}
+	}
+	m.Serve()
+}
+
+// Keeps running and takes orders over the control API (see internal/app/daemon.go)
+func runDaemon(cfg *app.Config) {
+	m := startManager(cfg)
+	logger.Log("role", map[string]any{"mode": "daemon"})
+	if err := app.RunDaemon(m, cfg); err != nil {
+		logger.Log("fatal", map[string]any{"err": err.Error()})
+		m.Close()
+		os.Exit(1)
+	}
+}
+
+// Manager whose torrents are flushed on Ctrl+C
+func startManager(cfg *app.Config) *app.Manager {
+	m, err := app.NewManager(cfg)
+	if err != nil {
+		logger.Log("fatal", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Log("shutdown", map[string]any{"signal": sig.String()})
+		m.Close()
+		os.Exit(1)
+	}()
+	return m
+}
@@ -0,0 +1,146 @@
+// Peer addresses of one torrent: how often they failed and when they may be dialed again
+
+package app
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+)
+
+const (
+	lookupPeriod = 30 * time.Second // DHT re-discovery
+	lookupRetry  = 5 * time.Second  // ... while no peer is connected
+	redialPeriod = time.Second      // how often due addresses are checked
+	backoffBase  = 5 * time.Second
+	backoffMax   = 5 * time.Minute
+	stableConn   = time.Minute // a connection that lived this long clears the failures
+)
+
+type addrEntry struct {
+	fails   int
+	nextTry time.Time
+	busy    bool      // dialing or connected
+	since   time.Time // when the current connection was made
+	ours    bool      // turned out to be ourselves, never dialed
+}
+
+type addrBook struct {
+	mu       sync.Mutex
+	selfPort string          // our listen port, "" until setSelf
+	localIPs map[string]bool // of our interfaces: with selfPort, addresses of ourselves
+	entries  map[string]*addrEntry
+}
+
+func newAddrBook() *addrBook {
+	return &addrBook{entries: make(map[string]*addrEntry)}
+}
+
+// Remembers *addrs*; new ones are due right away. Returns how many were new.
+func (ab *addrBook) add(addrs ...string) int {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	added := 0
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if a == "" || ab.isSelf(a) || ab.entries[a] != nil {
+			continue
+		}
+		ab.entries[a] = &addrEntry{}
+		added++
+	}
+	return added
+}
+
+// Our listen address is *listen*, usually a wildcard like [::]:6881. The DHT
+// hands our own announce back as <some IP of ours>:6881, so that is what is skipped.
+func (ab *addrBook) setSelf(listen string) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return
+	}
+	local := make(map[string]bool)
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+	ab.mu.Lock()
+	ab.selfPort, ab.localIPs = port, local
+	ab.mu.Unlock()
+}
+
+// (ab.mu held)
+func (ab *addrBook) isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || ab.selfPort == "" || port != ab.selfPort {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified() || ab.localIPs[ip.String()])
+}
+
+// The connection to *addr* reached ourselves (same peer ID): never again
+func (ab *addrBook) ours(addr string) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	if e := ab.entries[addr]; e != nil {
+		e.ours = true
+	}
+}
+
+// Addresses whose backoff expired; they are marked busy, the caller dials them
+func (ab *addrBook) due(now time.Time) []string {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	var out []string
+	for a, e := range ab.entries {
+		if !e.busy && !e.ours && !now.Before(e.nextTry) {
+			e.busy = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (ab *addrBook) connected(addr string) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	if e := ab.entries[addr]; e != nil {
+		e.since = time.Now()
+	}
+}
+
+// Dial failed or the connection dropped: try again later, backing off
+func (ab *addrBook) failed(addr string, reason string) {
+	ab.mu.Lock()
+	e := ab.entries[addr]
+	if e == nil || e.ours {
+		ab.mu.Unlock()
+		return
+	}
+	if !e.since.IsZero() && time.Since(e.since) >= stableConn {
+		e.fails = 0 // it worked for a while, start over
+	}
+	e.fails++
+	wait := backoffMax
+	if e.fails <= 6 { // past that the shift is over the max anyway, and overflows at 32
+		wait = min(backoffBase<<(e.fails-1), backoffMax)
+	}
+	e.nextTry = time.Now().Add(wait)
+	e.busy = false
+	e.since = time.Time{}
+	fails := e.fails
+	ab.mu.Unlock()
+
+	logger.Log("peer_retry", map[string]any{
+		"peer":   addr,
+		"reason": reason,
+		"fails":  fails,
+		"wait":   wait.String(),
+	})
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAddrBookBackoff(t *testing.T) {
+	ab := newAddrBook()
+	if n := ab.add("10.0.0.1:6881", " 10.0.0.1:6881", ""); n != 1 {
+		t.Fatalf("added %d, want 1", n)
+	}
+
+	now := time.Now()
+	if due := ab.due(now); len(due) != 1 {
+		t.Fatalf("new address not due: %v", due)
+	}
+	if due := ab.due(now); len(due) != 0 {
+		t.Fatalf("busy address handed out twice: %v", due)
+	}
+
+	const a = "10.0.0.1:6881"
+	var prev time.Duration
+	for i := 1; i <= 40; i++ {
+		before := time.Now()
+		ab.failed(a, "dial")
+		wait := ab.entries[a].nextTry.Sub(before)
+		if wait <= 0 || wait > backoffMax+time.Second {
+			t.Fatalf("after %d fails: wait %v", i, wait)
+		}
+		if wait+time.Second < prev {
+			t.Fatalf("after %d fails: wait went down from %v to %v", i, prev, wait)
+		}
+		prev = wait
+	}
+	if prev < backoffMax-time.Second {
+		t.Fatalf("40 fails wait only %v", prev)
+	}
+	if due := ab.due(time.Now()); len(due) != 0 {
+		t.Fatalf("due while backing off: %v", due)
+	}
+	if due := ab.due(time.Now().Add(backoffMax + time.Second)); len(due) != 1 {
+		t.Fatalf("not due after backoffMax: %v", due)
+	}
+}
+
+func TestAddrBookStableConnResets(t *testing.T) {
+	ab := newAddrBook()
+	const a = "10.0.0.1:6881"
+	ab.add(a)
+	for range 5 {
+		ab.due(time.Now().Add(time.Hour))
+		ab.failed(a, "dial")
+	}
+	ab.due(time.Now().Add(time.Hour))
+	ab.connected(a)
+	ab.entries[a].since = time.Now().Add(-stableConn) // lived long enough
+	ab.failed(a, "dropped")
+	if e := ab.entries[a]; e.fails != 1 {
+		t.Fatalf("fails = %d after a stable connection, want 1", e.fails)
+	}
+}
+
+// Our own announce comes back from the DHT with a real IP of ours,
+// not the wildcard we listen on
+func TestAddrBookSkipsSelf(t *testing.T) {
+	ab := newAddrBook()
+	ab.setSelf("[::]:6881")
+	local := "127.0.0.1"
+	for ip := range ab.localIPs {
+		if !net.ParseIP(ip).IsLoopback() {
+			local = ip
+		}
+	}
+	self := []string{"127.0.0.1:6881", "[::1]:6881", net.JoinHostPort(local, "6881")}
+	if n := ab.add(self...); n != 0 {
+		t.Fatalf("added %d of our own addresses", n)
+	}
+	if n := ab.add("127.0.0.1:7000", "203.0.113.5:6881"); n != 2 {
+		t.Fatalf("added %d, want other ports and hosts kept", n)
+	}
+
+	// Only the handshake tells: same peer ID as ours
+	const a = "203.0.113.5:6881"
+	ab.due(time.Now())
+	ab.ours(a)
+	ab.failed(a, "dropped")
+	ab.add(a)
+	if due := ab.due(time.Now().Add(time.Hour)); slices.Contains(due, a) {
+		t.Fatalf("ourselves dialed again: %v", due)
+	}
+}
@@ -0,0 +1,85 @@
+// Peers that keep sending corrupt pieces get banned
+
+package app
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+)
+
+// Hash failures a peer may cause before it is banned
+const banThreshold = 3
+
+// Strikes and bans, keyed by IP (ports change on reconnect) and peer ID
+type banList struct {
+	mu      sync.Mutex
+	strikes map[string]int
+	ips     map[string]bool
+	ids     map[[20]byte]bool
+}
+
+func newBanList() *banList {
+	return &banList{
+		strikes: make(map[string]int),
+		ips:     make(map[string]bool),
+		ids:     make(map[[20]byte]bool),
+	}
+}
+
+// Counts one failed piece against *p*. Returns true once *p* is banned.
+func (bl *banList) strike(p *peer.Peer, piece int) bool {
+	ip := hostOf(p.Conn.RemoteAddr().String())
+	bl.mu.Lock()
+	bl.strikes[ip]++
+	fails := bl.strikes[ip]
+	banned := fails >= banThreshold
+	fresh := banned && !bl.ips[ip] // late blocks keep failing after the ban
+	if banned {
+		bl.ips[ip] = true
+		bl.ids[p.RemoteID] = true
+	}
+	bl.mu.Unlock()
+
+	logger.Log("peer_hash_fail", map[string]any{
+		"peer":  p.Conn.RemoteAddr().String(),
+		"piece": piece,
+		"fails": fails,
+	})
+	if fresh {
+		logger.Log("peer_banned", map[string]any{
+			"ip":     ip,
+			"peerID": hex.EncodeToString(p.RemoteID[:]),
+			"fails":  fails,
+		})
+	}
+	return banned
+}
+
+// Whether connections from/to *addr* ("host:port" or bare host) are refused
+func (bl *banList) bannedAddr(addr string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return bl.ips[hostOf(addr)]
+}
+
+func (bl *banList) bannedID(id [20]byte) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return bl.ids[id]
+}
+
+// Logs a refused connection; *stage* is accept, dial or handshake
+func logRefused(addr, stage string) {
+	logger.Log("peer_refused", map[string]any{"peer": addr, "stage": stage, "reason": "banned"})
+}
+
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,38 @@
+package app
+
+import "testing"
+
+func TestBanList(t *testing.T) {
+	bl := newBanList()
+	first := idlePeer(t, "10.0.0.1:6881")
+	again := idlePeer(t, "10.0.0.1:7000") // same host after a reconnect
+	other := idlePeer(t, "10.0.0.2:6881")
+
+	if bl.strike(first, 0) || bl.strike(again, 1) {
+		t.Fatal("banned before banThreshold strikes")
+	}
+	if bl.strike(other, 0) {
+		t.Fatal("strikes of another host counted")
+	}
+	if !bl.strike(first, 2) {
+		t.Fatal("not banned after banThreshold strikes from one host")
+	}
+	if !bl.strike(again, 3) {
+		t.Fatal("late strikes must keep reporting the ban")
+	}
+
+	for _, addr := range []string{"10.0.0.1:6881", "10.0.0.1:1234", "10.0.0.1"} {
+		if !bl.bannedAddr(addr) {
+			t.Errorf("%s not banned", addr)
+		}
+	}
+	if bl.bannedAddr("10.0.0.2:6881") {
+		t.Error("innocent host banned")
+	}
+	if !bl.bannedID(first.RemoteID) || !bl.bannedID(again.RemoteID) {
+		t.Error("IDs of the banned host still admitted")
+	}
+	if bl.bannedID(other.RemoteID) {
+		t.Error("innocent ID banned")
+	}
+}
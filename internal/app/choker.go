@@ -0,0 +1,122 @@
+// Upload slots: who gets served. Tit-for-tat by rate plus one optimistic unchoke
+
+package app
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+)
+
+const (
+	rechokePeriod      = 10 * time.Second
+	optimisticRounds   = 3 // optimistic slot moves every 30 s
+	defaultUploadSlots = 4
+)
+
+// Rechoke state; only touched by the choker goroutine
+type choker struct {
+	sw         *Swarm
+	round      int
+	optimistic *peer.Peer           // currently unchoked for free, nil if none
+	last       map[*peer.Peer]int64 // byte counters at the previous rechoke
+}
+
+func uploadSlots(n int) int {
+	if n <= 0 {
+		return defaultUploadSlots
+	}
+	return n
+}
+
+// Runs the choker until the swarm is closed (seeding or downloading alike)
+func (sw *Swarm) StartChoker() {
+	c := &choker{sw: sw, last: make(map[*peer.Peer]int64)}
+	go func() {
+		ticker := time.NewTicker(rechokePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.rechoke()
+			case <-sw.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Unchokes the slots-1 interested peers that gave us the most bytes since the
+// last round (or took the most, once we only seed) plus one optimistic pick,
+// so newcomers and free riders still get a chance. Everybody else is choked.
+func (c *choker) rechoke() {
+	sw := c.sw
+	sw.mu.Lock()
+	peers := slices.Clone(sw.Peers)
+	seeding := !slices.Contains(sw.missing, true)
+	sw.mu.Unlock()
+
+	rate := make(map[*peer.Peer]int64, len(peers))
+	last := make(map[*peer.Peer]int64, len(peers))
+	var interested []*peer.Peer
+	for _, p := range peers {
+		total := p.Downloaded()
+		if seeding {
+			total = p.Uploaded()
+		}
+		rate[p] = total - c.last[p]
+		last[p] = total
+		if p.PeerInterested() {
+			interested = append(interested, p)
+		}
+	}
+	c.last = last // forgets peers that left
+	unchoke := c.choose(interested, rate)
+
+	var names []string
+	for _, p := range peers {
+		free := p == c.optimistic
+		p.SetChoking(!unchoke[p] && !free)
+		if unchoke[p] || free {
+			names = append(names, p.Conn.RemoteAddr().String())
+		}
+	}
+	logger.Log("rechoke", map[string]any{
+		"unchoked":   names,
+		"interested": len(interested),
+		"seeding":    seeding,
+	})
+}
+
+// Slot selection of one round: the slots-1 best *rate*s among *interested*
+// are returned, the optimistic pick lands in c.optimistic
+func (c *choker) choose(interested []*peer.Peer, rate map[*peer.Peer]int64) map[*peer.Peer]bool {
+	slices.SortStableFunc(interested, func(a, b *peer.Peer) int {
+		return cmp.Compare(rate[b], rate[a])
+	})
+	unchoke := make(map[*peer.Peer]bool)
+	for _, p := range interested[:min(c.sw.slots-1, len(interested))] {
+		unchoke[p] = true
+	}
+
+	// Keep the optimistic peer for a few rounds so it can prove itself
+	if c.round%optimisticRounds == 0 || unchoke[c.optimistic] ||
+		!slices.Contains(interested, c.optimistic) {
+		c.optimistic = nil
+		var pool []*peer.Peer
+		for _, p := range interested {
+			if !unchoke[p] {
+				pool = append(pool, p)
+			}
+		}
+		if len(pool) > 0 {
+			c.optimistic = pool[rand.IntN(len(pool))]
+		}
+	}
+	c.round++
+	return unchoke
+}
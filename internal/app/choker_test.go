@@ -0,0 +1,82 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+)
+
+// A connection that claims to come from *addr*
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// A peer that is never started: enough for bookkeeping that only looks
+// at its identity and address. Its remote ID is made up from *addr*.
+func idlePeer(t *testing.T, addr string) *peer.Peer {
+	t.Helper()
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	p := peer.New(addrConn{a, tcp}, nil, nil, [20]byte{}, [20]byte{})
+	copy(p.RemoteID[:], tcp.String())
+	return p
+}
+
+func TestChokerSlots(t *testing.T) {
+	c := &choker{sw: &Swarm{slots: 4}}
+	var interested []*peer.Peer
+	rate := map[*peer.Peer]int64{}
+	for i := range 6 {
+		p := idlePeer(t, fmt.Sprintf("10.0.0.%d:6881", i+1))
+		interested = append(interested, p)
+		rate[p] = int64(i * 100) // the last ones gave us the most
+	}
+	top := interested[3:]
+	rest := interested[:3]
+
+	unchoke := c.choose(append([]*peer.Peer(nil), interested...), rate)
+	if len(unchoke) != 3 {
+		t.Fatalf("%d rate slots, want slots-1 = 3", len(unchoke))
+	}
+	for _, p := range top {
+		if !unchoke[p] {
+			t.Fatalf("a top uploader got no slot")
+		}
+	}
+	opt := c.optimistic
+	if opt == nil || unchoke[opt] {
+		t.Fatalf("optimistic pick must be one of the others, got %v", opt)
+	}
+
+	// Kept until the optimistic rotation comes around
+	for round := 1; round < optimisticRounds; round++ {
+		c.choose(append([]*peer.Peer(nil), interested...), rate)
+		if c.optimistic != opt {
+			t.Fatalf("optimistic pick moved in round %d", round)
+		}
+	}
+
+	// Once it earns a real slot the optimistic one is picked again
+	c.round = 1
+	rate[opt] = 1000
+	unchoke = c.choose(append([]*peer.Peer(nil), interested...), rate)
+	if !unchoke[opt] || c.optimistic == opt || c.optimistic == nil {
+		t.Fatalf("optimistic peer with the best rate should hold a rate slot, pick another")
+	}
+
+	// Nobody left for the optimistic slot
+	c = &choker{sw: &Swarm{slots: 4}}
+	unchoke = c.choose(append([]*peer.Peer(nil), rest[:2]...), rate)
+	if len(unchoke) != 2 || c.optimistic != nil {
+		t.Fatalf("2 interested peers: %d unchoked, optimistic %v", len(unchoke), c.optimistic)
+	}
+}
@@ -0,0 +1,219 @@
+// One-shot subcommands that work on metainfo files: create, info, verify
+
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
+
+// Knobs of a freshly built metainfo; zero values mean defaults
+type MetaOptions struct {
+	PieceSize int    // bytes, storage.DefaultPiece if 0
+	Name      string // file/root name seen by leechers, base name of the payload if ""
+	Comment   string
+}
+
+// Hashes the payload at *dataPath* (piece by piece, not the whole file in RAM)
+func BuildMeta(dataPath string, opts MetaOptions) (*metainfo.Meta, error) {
+	name := opts.Name
+	if name == "" {
+		abs, err := filepath.Abs(dataPath) // "create ." names it after the directory
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Base(abs)
+	}
+	// Checked before hashing: Load refuses such a name anyway
+	if err := metainfo.CheckName(name); err != nil {
+		return nil, err
+	}
+	layout, err := storage.ScanPayload(dataPath, opts.PieceSize)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := storage.HashPayload(dataPath, layout)
+	if err != nil {
+		return nil, err
+	}
+	meta := &metainfo.Meta{
+		FileName:   name,
+		FileLength: layout.Length,
+		PieceSize:  layout.PieceSize,
+		Hashes:     hashes,
+		Comment:    opts.Comment,
+	}
+	for _, f := range layout.Files { // empty for a single file
+		meta.Files = append(meta.Files, metainfo.File{Path: f.Path, Length: f.Length})
+	}
+	return meta, nil
+}
+
+// Saves *meta* as .torrent (bencode) or .bit (JSON), picked by the extension
+func WriteMeta(meta *metainfo.Meta, path string) error {
+	if strings.HasSuffix(path, ".torrent") {
+		return meta.WriteTorrent(path)
+	}
+	return meta.Write(path)
+}
+
+// bittorrent create [flags] <path>
+func RunCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	pieceSize := fs.String("piece-size", "256k", "piece size: bytes or with k/m suffix, a power of two >= 16k")
+	name := fs.String("name", "", "name leechers save the payload as (default: base name of <path>)")
+	comment := fs.String("comment", "", "free-text comment stored in the metainfo")
+	format := fs.String("format", "bit", "bit (JSON) or torrent (bencode)")
+	out := fs.String("o", "", "output file (default: <path>.<format>, where seed looks for it)")
+	fs.Usage = usageOf(fs, "create [flags] <path>", "Builds a metainfo file for a payload file or directory without seeding it.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != "bit" && *format != "torrent" {
+		return fmt.Errorf("unknown -format %q, want bit or torrent", *format)
+	}
+	size, err := parseSize(*pieceSize)
+	if err != nil {
+		return err
+	}
+	if size < protocol.BlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("-piece-size %s: want a power of two >= 16k", *pieceSize)
+	}
+
+	dataPath := filepath.Clean(fs.Arg(0))
+	meta, err := BuildMeta(dataPath, MetaOptions{PieceSize: size, Name: *name, Comment: *comment})
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = dataPath + "." + *format
+	}
+	if err := WriteMeta(meta, path); err != nil {
+		return err
+	}
+	fmt.Printf("%s\ninfohash %x\n", path, meta.InfoHash())
+	return nil
+}
+
+// bittorrent info <meta>
+func RunInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.Usage = usageOf(fs, "info <meta.bit|meta.torrent>", "Prints what a metainfo file describes.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	meta, err := metainfo.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ih := meta.InfoHash()
+	fmt.Printf("name:       %s\n", meta.FileName)
+	fmt.Printf("infohash:   %x\n", ih)
+	fmt.Printf("magnet:     %s\n", metainfo.MagnetURI(ih, meta.FileName))
+	fmt.Printf("size:       %s (%d bytes)\n", humanBytes(meta.FileLength), meta.FileLength)
+	fmt.Printf("pieces:     %d x %s\n", len(meta.Hashes), humanBytes(int64(meta.PieceSize)))
+	if meta.Comment != "" {
+		fmt.Printf("comment:    %s\n", meta.Comment)
+	}
+	if meta.IsMultiFile() {
+		fmt.Printf("files:      %d\n", len(meta.Files))
+		for _, f := range meta.Files {
+			fmt.Printf("  %10s  %s\n", humanBytes(f.Length), f.Path)
+		}
+	}
+	return nil
+}
+
+// bittorrent verify [flags] <meta> [path]
+func RunVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	kind := fs.String("storage", storage.KindFile, "how to read the data: file or mmap")
+	fs.Usage = usageOf(fs, "verify [flags] <meta> [path]",
+		"Hashes local data against a metainfo file. <path> defaults to the torrent name next to <meta>.\nExits 1 unless every piece matches.")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *kind == storage.KindMemory {
+		return errors.New("verify reads data from disk, use -storage file or mmap")
+	}
+	meta, err := metainfo.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	dataPath := filepath.Join(filepath.Dir(fs.Arg(0)), meta.FileName)
+	if fs.NArg() == 2 {
+		dataPath = fs.Arg(1)
+	}
+	store, err := storage.Open(*kind, dataPath, layoutOf(meta), false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	have := storage.Verify(store, meta.Hashes)
+	var bad []string
+	for i := range have {
+		if !have.Has(i) {
+			bad = append(bad, strconv.Itoa(i))
+		}
+	}
+	nbad := len(bad)
+	fmt.Printf("%s: %d/%d pieces ok\n", dataPath, len(have)-nbad, len(have))
+	if nbad > 0 {
+		const maxListed = 20
+		if len(bad) > maxListed {
+			bad = append(bad[:maxListed], "...")
+		}
+		fmt.Printf("bad pieces: %s\n", strings.Join(bad, " "))
+		return fmt.Errorf("%d pieces missing or corrupt", nbad)
+	}
+	return nil
+}
+
+// "262144", "256k", "4m" (0 is fine, callers check the range)
+func parseSize(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		mult = 1 << 20
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
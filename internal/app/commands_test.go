@@ -0,0 +1,32 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildMetaName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "payload")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../x", "a/b", "/etc", ".."} {
+		if _, err := BuildMeta(dir, MetaOptions{Name: name}); err == nil {
+			t.Errorf("-name %q accepted", name)
+		}
+	}
+
+	// Default: the payload's own name, even when given as "."
+	t.Chdir(dir)
+	meta, err := BuildMeta(".", MetaOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.FileName != "payload" {
+		t.Fatalf("name %q, want payload", meta.FileName)
+	}
+}
@@ -2,29 +2,166 @@
 
 package app
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
 
 type Config struct {
-	SeedPath       string
-	MetaPath       string
+	SeedPath       string   // first -seed
+	MetaPath       string   // first -get
+	SeedPaths      []string // every -seed, more than one torrent runs a Manager
+	MetaPaths      []string // every -get
 	Listen         string
 	DestDir        string
 	DHTListen      string
 	PeersCSV       string
 	BootstrapCSV   string
 	KeepSeedingSec int
+	StorageKind    string
+	MetaFormat     string
+	Pipeline       int
+	UploadSlots    int
+	APIListen      string // daemon only
+	APITokenFile   string // daemon only: where the API token is written
+	UpRate         int64  // global limits in bytes/s, 0 = unlimited
+	DownRate       int64
+	PeerUpRate     int64 // cap of every connection
+	PeerDownRate   int64
 }
 
-func ParseFlags() *Config {
+// Flags of one subcommand: seed, get, dht, daemon, or "" for the old flat
+// form where the mode follows from -seed/-get. seed and get also take
+// their paths as arguments. Exits on bad flags, like the flag package.
+func ParseFlags(cmd string, args []string) *Config {
 	var c Config
-	flag.StringVar(&c.SeedPath, "seed", "", "path to payload to seed")
-	flag.StringVar(&c.MetaPath, "get", "", "path to .bit file to download")
-	flag.StringVar(&c.PeersCSV, "peer", "", "comma-separated peers")
-	flag.StringVar(&c.Listen, "tcp-listen", ":0", "TCP listen addr")
-	flag.StringVar(&c.DestDir, "dest", ".", "download output dir")
-	flag.StringVar(&c.DHTListen, "dht-listen", ":0", "UDP addr for DHT ('' to disable)")
-	flag.StringVar(&c.BootstrapCSV, "bootstrap", "", "comma-separated UDP bootstrap nodes")
-	flag.IntVar(&c.KeepSeedingSec, "keep", 0, "seconds to keep seeding after complete")
-	flag.Parse()
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	net := func() {
+		fs.StringVar(&c.Listen, "tcp-listen", ":0", "TCP listen addr")
+		fs.StringVar(&c.DHTListen, "dht-listen", ":0", "UDP addr for DHT ('' to disable)")
+		fs.StringVar(&c.BootstrapCSV, "bootstrap", "", "comma-separated UDP bootstrap nodes")
+	}
+	format := func() {
+		fs.StringVar(&c.MetaFormat, "format", "bit", "metainfo written on first seed: bit (JSON) or torrent (bencode)")
+	}
+	serve := func() {
+		fs.IntVar(&c.UploadSlots, "upload-slots", 4, "peers served at once (one of them optimistic)")
+		fs.StringVar(&c.StorageKind, "storage", storage.KindFile, "piece storage backend: file, mmap or memory")
+	}
+	rates := func() {
+		fs.Var((*rateFlag)(&c.UpRate), "up-rate", "upload limit for all torrents, bytes/s with k/m suffix (0 = none)")
+		fs.Var((*rateFlag)(&c.DownRate), "down-rate", "download limit for all torrents, bytes/s with k/m suffix (0 = none)")
+		fs.Var((*rateFlag)(&c.PeerUpRate), "peer-up-rate", "upload limit of each connection (0 = none)")
+		fs.Var((*rateFlag)(&c.PeerDownRate), "peer-down-rate", "download limit of each connection (0 = none)")
+	}
+	get := func() {
+		fs.StringVar(&c.PeersCSV, "peer", "", "comma-separated peers")
+		fs.StringVar(&c.DestDir, "dest", ".", "download output dir")
+		fs.IntVar(&c.KeepSeedingSec, "keep", 0, "seconds to keep seeding after complete")
+		fs.IntVar(&c.Pipeline, "pipeline", 5, "outstanding block requests per peer")
+	}
+
+	switch cmd {
+	case "seed":
+		net()
+		serve()
+		format()
+		rates()
+		fs.Usage = usageOf(fs, "seed [flags] <path>...",
+			"Seeds payload files or directories. <path>.bit is written on the first run and reused after.")
+	case "get":
+		net()
+		serve()
+		get()
+		rates()
+		fs.Usage = usageOf(fs, "get [flags] <meta|magnet>...",
+			"Downloads from .bit/.torrent files or magnet links, serving pieces to others meanwhile.")
+	case "dht":
+		fs.StringVar(&c.DHTListen, "dht-listen", ":0", "UDP addr for DHT")
+		fs.StringVar(&c.BootstrapCSV, "bootstrap", "", "comma-separated UDP bootstrap nodes")
+		fs.Usage = usageOf(fs, "dht [flags]", "Runs a bare DHT node, e.g. as a bootstrap node for others.")
+	case "daemon", "":
+		net()
+		serve()
+		format()
+		get()
+		rates()
+		fs.Var((*listFlag)(&c.SeedPaths), "seed", "path to payload file or directory to seed (repeatable)")
+		fs.Var((*listFlag)(&c.MetaPaths), "get", "path to .bit/.torrent file or magnet link to download (repeatable)")
+		if cmd == "daemon" {
+			fs.StringVar(&c.APIListen, "api", DefaultAPI, "HTTP control API listen addr (keep it local)")
+			fs.StringVar(&c.APITokenFile, "token-file", DefaultTokenFile(), "where the API token for ctl is written")
+			fs.Usage = usageOf(fs, "daemon [flags]",
+				"Keeps running and takes orders over a local HTTP/JSON API (see `bittorrent ctl`).")
+		}
+	}
+	fs.Parse(args)
+
+	switch cmd {
+	case "seed":
+		c.SeedPaths = fs.Args()
+	case "get":
+		c.MetaPaths = fs.Args()
+	}
+	if (cmd == "seed" || cmd == "get") && fs.NArg() == 0 || cmd == "dht" && fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if c.MetaFormat != "" && c.MetaFormat != "bit" && c.MetaFormat != "torrent" {
+		fmt.Fprintf(os.Stderr, "unknown -format %q, want bit or torrent\n", c.MetaFormat)
+		os.Exit(2)
+	}
+	if len(c.SeedPaths) > 0 {
+		c.SeedPath = c.SeedPaths[0]
+	}
+	if len(c.MetaPaths) > 0 {
+		c.MetaPath = c.MetaPaths[0]
+	}
 	return &c
 }
+
+// Help text of a subcommand: usage line, what it does, then its flags
+func usageOf(fs *flag.FlagSet, synopsis, about string) func() {
+	return func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "usage: bittorrent %s\n\n%s\n", synopsis, about)
+		if hasFlags(fs) {
+			fmt.Fprintln(w, "\nflags:")
+			fs.PrintDefaults()
+		}
+	}
+}
+
+func hasFlags(fs *flag.FlagSet) (found bool) {
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// Torrents given on the command line
+func (c *Config) NumTorrents() int { return len(c.SeedPaths) + len(c.MetaPaths) }
+
+// A flag that may be given several times
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Bytes per second: "0", "500000", "512k", "2m"
+type rateFlag int64
+
+func (r *rateFlag) String() string { return strconv.FormatInt(int64(*r), 10) }
+
+func (r *rateFlag) Set(v string) error {
+	n, err := parseSize(v)
+	*r = rateFlag(n)
+	return err
+}
@@ -0,0 +1,198 @@
+// `bittorrent ctl`: command-line client of the daemon's control API
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+)
+
+const ctlUsage = `usage: bittorrent ctl [-api addr] [-token-file path] <command>
+
+commands:
+  list                          all torrents
+  show <infohash>               one torrent
+  add [-dest dir] <meta>        download a .bit/.torrent file, magnet link or infohash
+  seed <path>                   seed a payload file or directory
+  pause <infohash>
+  resume <infohash>
+  remove <infohash>             stop and forget, data stays on disk
+  limit [flags] [infohash]      show or change limits (bytes/s, k/m suffix, 0 = none):
+                                global with no infohash, that torrent's otherwise
+      -up, -down                upload/download limit
+      -peer-up, -peer-down      cap of each connection (global only)
+`
+
+// Runs one ctl command and prints the daemon's JSON answer to stdout
+func RunCtl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	api := fs.String("api", DefaultAPI, "daemon control API addr")
+	tokenFile := fs.String("token-file", DefaultTokenFile(), "API token written by the daemon")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, ctlUsage) }
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("no API token (is the daemon running?): %w", err)
+	}
+	c := &ctlClient{
+		base:  "http://" + *api,
+		token: strings.TrimSpace(string(token)),
+		http:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		return c.do("GET", "/torrents", nil)
+	case "add":
+		sub := flag.NewFlagSet("add", flag.ExitOnError)
+		dest := sub.String("dest", "", "download dir (daemon's -dest if empty)")
+		sub.Parse(rest)
+		if sub.NArg() != 1 {
+			return errors.New("add needs one .bit/.torrent path, magnet link or infohash")
+		}
+		req := AddRequest{Get: sub.Arg(0), Dest: absPath(*dest)}
+		if _, err := os.Stat(req.Get); err == nil { // a local file, not an infohash
+			req.Get = absPath(req.Get)
+		}
+		return c.do("POST", "/torrents", req)
+	case "seed":
+		if len(rest) != 1 {
+			return errors.New("seed needs one path")
+		}
+		return c.do("POST", "/torrents", AddRequest{Seed: absPath(rest[0])})
+	case "limit":
+		return c.limit(rest)
+	case "show", "pause", "resume", "remove":
+		if len(rest) != 1 {
+			return fmt.Errorf("%s needs one infohash", cmd)
+		}
+		path := "/torrents/" + rest[0]
+		switch cmd {
+		case "show":
+			return c.do("GET", path, nil)
+		case "remove":
+			return c.do("DELETE", path, nil)
+		}
+		return c.do("POST", path+"/"+cmd, nil)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// Shows the limits without flags, changes the given ones otherwise
+func (c *ctlClient) limit(args []string) error {
+	fs := flag.NewFlagSet("limit", flag.ExitOnError)
+	for _, name := range []string{"up", "down", "peer-up", "peer-down"} {
+		fs.Var(new(rateFlag), name, "bytes/s")
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New("limit takes at most one infohash")
+	}
+
+	var rl RateLimits
+	changed := false
+	fs.Visit(func(f *flag.Flag) {
+		n := int64(*f.Value.(*rateFlag))
+		switch f.Name {
+		case "up":
+			rl.Up = &n
+		case "down":
+			rl.Down = &n
+		case "peer-up":
+			rl.PeerUp = &n
+		case "peer-down":
+			rl.PeerDown = &n
+		}
+		changed = true
+	})
+
+	path := "/limits"
+	if fs.NArg() == 1 {
+		path = "/torrents/" + fs.Arg(0) + "/limits"
+	}
+	switch {
+	case changed:
+		return c.do("PUT", path, rl)
+	case fs.NArg() == 1:
+		return c.do("GET", "/torrents/"+fs.Arg(0), nil) // upLimit/downLimit are in the stats
+	}
+	return c.do("GET", path, nil)
+}
+
+type ctlClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// Sends one request; 2xx bodies go to stdout, errors come back as error
+func (c *ctlClient) do(method, path string, body any) error {
+	var rd io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct{ Error string }
+		if json.Unmarshal(raw, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, raw, "", "  ") != nil {
+		out.Reset()
+		out.Write(raw)
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
+
+// The daemon has its own working directory, so paths are sent absolute
+func absPath(p string) string {
+	if p == "" || metainfo.IsMagnet(p) {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
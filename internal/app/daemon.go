@@ -0,0 +1,283 @@
+// `bittorrent daemon`: a Manager that keeps running, driven over a local HTTP/JSON API
+//
+//	GET    /torrents              list (TorrentStats)
+//	POST   /torrents              add: {"get": "<.bit|.torrent|magnet|infohash>", "dest": "<dir>"}
+//	                                or {"seed": "<payload path>"}
+//	GET    /torrents/{ih}         one torrent
+//	POST   /torrents/{ih}/pause
+//	POST   /torrents/{ih}/resume
+//	DELETE /torrents/{ih}         stop and forget (data stays on disk)
+//	GET    /limits                global limits and per-connection caps (RateLimits)
+//	PUT    /limits                change them, omitted fields stay
+//	PUT    /torrents/{ih}/limits  {"up": n, "down": n} of one torrent, bytes/s, 0 = none
+//
+// Errors come back as {"error": "..."} with a 4xx status.
+//
+// Every request needs "Authorization: Bearer <token>", the token being what
+// the daemon wrote to its token file at start. Requests from browsers are
+// refused: an Origin header, a Host that isn't ours (DNS rebinding) or a
+// POST/PUT that isn't application/json (a "simple" cross-site form post).
+
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+)
+
+// Loopback only, and every request needs the token written by writeToken
+const DefaultAPI = "127.0.0.1:6880"
+
+// Body of POST /torrents; exactly one of Get and Seed is set
+type AddRequest struct {
+	Get  string `json:"get,omitempty"`
+	Seed string `json:"seed,omitempty"`
+	Dest string `json:"dest,omitempty"` // download dir, -dest of the daemon if empty
+}
+
+// Runs the daemon until the process is killed. Torrents from -seed/-get
+// are added before the API starts answering.
+func RunDaemon(m *Manager, cfg *Config) error {
+	for _, path := range cfg.SeedPaths {
+		if _, err := m.AddSeed(path); err != nil {
+			logger.Log("add_err", map[string]any{"path": path, "err": err.Error()})
+		}
+	}
+	for _, path := range cfg.MetaPaths {
+		if _, err := m.AddGet(path, ""); err != nil {
+			logger.Log("add_err", map[string]any{"path": path, "err": err.Error()})
+		}
+	}
+
+	token, err := writeToken(cfg.APITokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to write API token: %w", err)
+	}
+	ln, err := net.Listen("tcp", cfg.APIListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.APIListen, err)
+	}
+	go m.Serve()
+	go m.sampleRates()
+	logger.Log("daemon_ready", map[string]any{"api": ln.Addr().String(), "tcp": m.Addr(), "tokenFile": cfg.APITokenFile})
+	return http.Serve(ln, guard(m.apiHandler(), token, ln.Addr().String()))
+}
+
+// Where the daemon leaves its API token for ctl, readable by this user only
+func DefaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "bittorrent", "api-token")
+}
+
+// A fresh random token in *path* (mode 0600); old ones stop working
+func writeToken(path string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	os.Remove(path) // WriteFile keeps the mode of an existing file
+	return token, os.WriteFile(path, []byte(token+"\n"), 0o600)
+}
+
+// Turns away everything but ctl-like clients that know the token
+func guard(next http.Handler, token, listen string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status int
+		var why string
+		switch {
+		case r.Header.Get("Origin") != "":
+			status, why = http.StatusForbidden, "requests from web pages are not allowed"
+		case !localHost(r.Host, listen):
+			status, why = http.StatusForbidden, fmt.Sprintf("bad host %q", r.Host)
+		case subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1:
+			status, why = http.StatusUnauthorized, "missing or wrong API token"
+		case (r.Method == http.MethodPost || r.Method == http.MethodPut) && !isJSON(r.Header.Get("Content-Type")):
+			status, why = http.StatusUnsupportedMediaType, "body must be application/json"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Log("api_refused", map[string]any{"from": r.RemoteAddr, "path": r.URL.Path, "reason": why})
+		writeJSON(w, status, map[string]string{"error": why})
+	})
+}
+
+// Host header names a loopback address or the one we listen on
+func localHost(host, listen string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if l, _, err := net.SplitHostPort(listen); err == nil && host == l {
+		return true
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "application/json"
+}
+
+func (m *Manager) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /torrents", m.handleList)
+	mux.HandleFunc("POST /torrents", m.handleAdd)
+	mux.HandleFunc("GET /torrents/{ih}", m.withTorrent(func(ih [20]byte) error { return nil }))
+	mux.HandleFunc("POST /torrents/{ih}/pause", m.withTorrent(m.Pause))
+	mux.HandleFunc("POST /torrents/{ih}/resume", m.withTorrent(m.Resume))
+	mux.HandleFunc("DELETE /torrents/{ih}", m.handleRemove)
+	mux.HandleFunc("GET /limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Limits())
+	})
+	mux.HandleFunc("PUT /limits", m.handleLimits)
+	mux.HandleFunc("PUT /torrents/{ih}/limits", m.handleLimits)
+	return mux
+}
+
+func (m *Manager) handleList(w http.ResponseWriter, r *http.Request) {
+	list := []TorrentStats{} // [] rather than null when empty
+	for _, sess := range m.Torrents() {
+		list = append(list, sess.Stats())
+	}
+	slices.SortFunc(list, func(a, b TorrentStats) int { return strings.Compare(a.Name, b.Name) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (m *Manager) handleAdd(w http.ResponseWriter, r *http.Request) {
+	var req AddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, fmt.Errorf("bad body: %w", err))
+		return
+	}
+	var (
+		sess *Session
+		err  error
+	)
+	switch {
+	case req.Get != "" && req.Seed == "":
+		sess, err = m.AddGet(metaOrMagnet(req.Get), req.Dest)
+	case req.Seed != "" && req.Get == "":
+		sess, err = m.AddSeed(req.Seed)
+	default:
+		err = errors.New(`need exactly one of "get" and "seed"`)
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sess.Stats())
+}
+
+func (m *Manager) handleRemove(w http.ResponseWriter, r *http.Request) {
+	ih, err := parseInfoHash(r.PathValue("ih"))
+	if err == nil {
+		err = m.Remove(ih)
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Global limits, or one torrent's when the path names it
+func (m *Manager) handleLimits(w http.ResponseWriter, r *http.Request) {
+	var rl RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&rl); err != nil {
+		writeErr(w, fmt.Errorf("bad body: %w", err))
+		return
+	}
+	for _, v := range []*int64{rl.Up, rl.Down, rl.PeerUp, rl.PeerDown} {
+		if v != nil && *v < 0 {
+			writeErr(w, errors.New("limits must be >= 0"))
+			return
+		}
+	}
+	if r.PathValue("ih") == "" {
+		m.SetLimits(rl)
+		writeJSON(w, http.StatusOK, m.Limits())
+		return
+	}
+	m.withTorrent(func(ih [20]byte) error { return m.SetTorrentLimits(ih, rl) })(w, r)
+}
+
+// Runs *op* on the torrent named in the path and answers with its stats
+func (m *Manager) withTorrent(op func([20]byte) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ih, err := parseInfoHash(r.PathValue("ih"))
+		if err == nil {
+			err = op(ih)
+		}
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		sess := m.Get(ih)
+		if sess == nil {
+			writeErr(w, ErrUnknownTorrent)
+			return
+		}
+		writeJSON(w, http.StatusOK, sess.Stats())
+	}
+}
+
+// A bare 40-hex infohash becomes a magnet link, anything else is passed on
+func metaOrMagnet(s string) string {
+	if ih, err := parseInfoHash(s); err == nil {
+		return metainfo.MagnetURI(ih, "")
+	}
+	return s
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var ih [20]byte
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != len(ih) {
+		return ih, fmt.Errorf("bad infohash %q", s)
+	}
+	copy(ih[:], raw)
+	return ih, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrUnknownTorrent):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrNotReady):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
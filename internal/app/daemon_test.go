@@ -0,0 +1,50 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := guard(ok, "secret", "127.0.0.1:6880")
+
+	req := func(method, host, ctype string, hdr map[string]string) int {
+		r := httptest.NewRequest(method, "/torrents", strings.NewReader(`{"seed":"/home/u/.ssh"}`))
+		r.Host = host
+		if ctype != "" {
+			r.Header.Set("Content-Type", ctype)
+		}
+		r.Header.Set("Authorization", "Bearer secret")
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	cases := []struct {
+		name         string
+		method, host string
+		ctype        string
+		hdr          map[string]string
+		want         int
+	}{
+		{"ctl", "POST", "127.0.0.1:6880", "application/json", nil, http.StatusTeapot},
+		{"get without body", "GET", "localhost:6880", "", nil, http.StatusTeapot},
+		{"text/plain form post", "POST", "127.0.0.1:6880", "text/plain", nil, http.StatusUnsupportedMediaType},
+		{"no content type", "PUT", "127.0.0.1:6880", "", nil, http.StatusUnsupportedMediaType},
+		{"from a web page", "POST", "127.0.0.1:6880", "application/json", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"dns rebinding", "GET", "evil.example:6880", "", nil, http.StatusForbidden},
+		{"no token", "GET", "127.0.0.1:6880", "", map[string]string{"Authorization": ""}, http.StatusUnauthorized},
+		{"wrong token", "GET", "127.0.0.1:6880", "", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if got := req(c.method, c.host, c.ctype, c.hdr); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package app
 
 import (
-	"encoding/hex"
 	"strings"
 
 	"github.com/BitTorrentFileSharing/bittorrent/internal/dht"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
 )
 
+// Announcements expire after dht.AnnounceTTL; renewing at a third of
+// it still leaves us listed if one or two announces get lost
+const reannouncePeriod = dht.AnnounceTTL / 3
+
 type DHTService struct {
 	Node *dht.DHTNode
 }
@@ -24,73 +27,44 @@ func StartDHT(listen string, bootstrapCSV string) (*DHTService, error) {
 		return nil, err
 	}
 
-	// Bootstrap new nodes in background
-	go func() {
-		for host := range strings.SplitSeq(bootstrapCSV, ",") {
-			if host != "" {
-				dhtNode.Ping(host)
-			}
+	// Bootstrap new nodes in background, all at once
+	for host := range strings.SplitSeq(bootstrapCSV, ",") {
+		if host != "" {
+			go func() {
+				if !dhtNode.Ping(host) {
+					logger.Log("dht_bootstrap_unreachable", map[string]any{"addr": host})
+				}
+			}()
 		}
-	}()
+	}
 
 	return &DHTService{Node: dhtNode}, nil
 }
 
+// Stops the node; nil-safe like the other methods
+func (svc *DHTService) Close() {
+	if svc != nil {
+		svc.Node.Close()
+	}
+}
+
+// Iterative lookup towards *infoHash*: seeders known by the nodes on the way
 func (svc *DHTService) LookupPeers(infoHash [20]byte) []string {
 	if svc == nil {
 		return nil
 	}
-
-	const (
-		alpha     = 10 // num of parallel queries
-		maxRounds = 10  // iterative depth
-		maxPeers  = 50 // stop early criteria
-	)
-
-	hexedInfoHash := hex.EncodeToString(infoHash[:])
-
-	seen := map[string]struct{}{} // Just a set
-	queue := svc.Node.RoutingTable.Closest(infoHash, alpha)
-
-	// START LOGS
-	var dht_addresses []string
-	for _, dht := range queue {
-		dht_addresses = append(dht_addresses, dht.Addr.String())
-	}
-	logger.Log("leecher_peers_lookup", map[string]any{"available_dhts": dht_addresses})
-	// END LOGS
-
-	for round := 0; round < maxRounds && len(queue) > 0 && len(seen) < maxPeers; round++ {
-		target := queue[0]
-		queue = queue[1:]
-
-		// 1. Send FIND PEERS message
-		reply := svc.Node.FindPeers(target.Addr.String(), hexedInfoHash)
-		logger.Log("dht_lookup_reply",
-			map[string]any{"from": target.Addr.String(), "peers": reply})
-
-		// Add strings to map
-		for _, addr := range reply {
-			if _, ok := seen[addr]; ok {
-				continue
-			}
-			seen[addr] = struct{}{}
-		}
-	}
-
-	// Convert map -> slice
-	out := make([]string, 0, len(seen))
-	for peer := range seen {
-		out = append(out, peer)
-	}
-	return out
+	return svc.Node.LookupPeers(infoHash).Peers
 }
 
-// Seeder side
-func (svc *DHTService) Announce(infoHash [20]byte, tcpAddr string) {
+// Seeder side: stores *tcpAddr* on the nodes closest to *infoHash*.
+// Returns their UDP addresses, none if no node answered the lookup.
+func (svc *DHTService) Announce(infoHash [20]byte, tcpAddr string) []string {
 	if svc == nil {
-		return
+		return nil
+	}
+	var told []string
+	for _, p := range svc.Node.Announce(infoHash, tcpAddr) {
+		told = append(told, p.Addr.String())
 	}
-	hexInfoHash := hex.EncodeToString(infoHash[:])
-	svc.Node.Announce(hexInfoHash, tcpAddr)
+	return told
 }
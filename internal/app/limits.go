@@ -0,0 +1,126 @@
+// Bandwidth limits: global, per torrent and per connection, changeable at runtime
+
+package app
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/ratelimit"
+)
+
+// One limiter per direction, in bytes/s (0 = unlimited)
+type Limits struct {
+	Up, Down *ratelimit.Limiter
+}
+
+func newLimits(up, down int64) Limits {
+	return Limits{Up: ratelimit.New(up), Down: ratelimit.New(down)}
+}
+
+// Limits shared by every torrent of the process, plus the cap each
+// connection gets. Owned by the Manager, or by a lone Session.
+type throttle struct {
+	global   Limits
+	peerUp   atomic.Int64
+	peerDown atomic.Int64
+}
+
+func newThrottle(cfg *Config) *throttle {
+	t := &throttle{global: newLimits(cfg.UpRate, cfg.DownRate)}
+	t.peerUp.Store(cfg.PeerUpRate)
+	t.peerDown.Store(cfg.PeerDownRate)
+	return t
+}
+
+// Limits as the control API shows and takes them, bytes/s.
+// In a change, nil fields are left alone.
+type RateLimits struct {
+	Up       *int64 `json:"up,omitempty"`
+	Down     *int64 `json:"down,omitempty"`
+	PeerUp   *int64 `json:"peerUp,omitempty"`   // global only: cap of each connection
+	PeerDown *int64 `json:"peerDown,omitempty"` // global only
+}
+
+// Piece traffic of *p* passes the global, torrent and its own limiters
+// (sw.mu held)
+func (sw *Swarm) limitPeer(p *peer.Peer) {
+	thr := sw.Sess.thr
+	own := newLimits(thr.peerUp.Load(), thr.peerDown.Load())
+	sw.caps[p] = own
+	p.UpLimits = []*ratelimit.Limiter{thr.global.Up, sw.Sess.limits.Up, own.Up}
+	p.DownLimits = []*ratelimit.Limiter{thr.global.Down, sw.Sess.limits.Down, own.Down}
+}
+
+// New per-connection caps, applied to the open connections too
+func (sw *Swarm) capPeers(up, down int64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for _, own := range sw.caps {
+		own.Up.SetRate(up)
+		own.Down.SetRate(down)
+	}
+}
+
+func ptr(n int64) *int64 { return &n }
+
+// Global limits and per-connection caps
+func (m *Manager) Limits() RateLimits {
+	t := m.thr
+	return RateLimits{
+		Up:       ptr(t.global.Up.Rate()),
+		Down:     ptr(t.global.Down.Rate()),
+		PeerUp:   ptr(t.peerUp.Load()),
+		PeerDown: ptr(t.peerDown.Load()),
+	}
+}
+
+func (m *Manager) SetLimits(rl RateLimits) {
+	t := m.thr
+	if rl.Up != nil {
+		t.global.Up.SetRate(*rl.Up)
+	}
+	if rl.Down != nil {
+		t.global.Down.SetRate(*rl.Down)
+	}
+	if rl.PeerUp != nil {
+		t.peerUp.Store(*rl.PeerUp)
+	}
+	if rl.PeerDown != nil {
+		t.peerDown.Store(*rl.PeerDown)
+	}
+	if rl.PeerUp != nil || rl.PeerDown != nil {
+		for _, sess := range m.Torrents() {
+			if sw := sess.swarm(); sw != nil {
+				sw.capPeers(t.peerUp.Load(), t.peerDown.Load())
+			}
+		}
+	}
+	logger.Log("limits_set", map[string]any{"scope": "global", "limits": m.Limits()})
+}
+
+// Limits of one torrent
+func (sess *Session) Limits() RateLimits {
+	return RateLimits{Up: ptr(sess.limits.Up.Rate()), Down: ptr(sess.limits.Down.Rate())}
+}
+
+func (m *Manager) SetTorrentLimits(ih [20]byte, rl RateLimits) error {
+	sess := m.Get(ih)
+	if sess == nil {
+		return ErrUnknownTorrent
+	}
+	if rl.PeerUp != nil || rl.PeerDown != nil {
+		return errors.New("per-connection caps are global, set them without an infohash")
+	}
+	if rl.Up != nil {
+		sess.limits.Up.SetRate(*rl.Up)
+	}
+	if rl.Down != nil {
+		sess.limits.Down.SetRate(*rl.Down)
+	}
+	logger.Log("limits_set", map[string]any{"scope": hex.EncodeToString(ih[:]), "limits": sess.Limits()})
+	return nil
+}
@@ -0,0 +1,297 @@
+// Many torrents in one process: one TCP listener and one DHT node shared by all
+
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+// How long an inbound connection may take to say which torrent it wants
+const routeTimeout = 10 * time.Second
+
+var (
+	ErrUnknownTorrent = errors.New("unknown torrent")
+	ErrDuplicate      = errors.New("torrent already added")
+	ErrNotReady       = errors.New("torrent is still starting")
+)
+
+// Manager hosts many torrents. Inbound connections are routed
+// to the right Session by the infohash in their handshake.
+type Manager struct {
+	cfg    *Config
+	DHT    *DHTService // shared by every torrent, nil if disabled
+	ln     net.Listener
+	peerID [20]byte
+	thr    *throttle // global limits and per-connection caps
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Session
+}
+
+// Starts the shared DHT node and TCP listener. Call Serve to accept peers.
+func NewManager(cfg *Config) (*Manager, error) {
+	dhtSvc, err := StartDHT(cfg.DHTListen, cfg.BootstrapCSV)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Listen, err)
+	}
+	logger.Log("manager_ready", map[string]any{"tcp": ln.Addr().String()})
+	return &Manager{
+		cfg:      cfg,
+		DHT:      dhtSvc,
+		ln:       ln,
+		peerID:   protocol.RandomPeerID(),
+		thr:      newThrottle(cfg),
+		torrents: make(map[[20]byte]*Session),
+	}, nil
+}
+
+// Addr is the shared TCP listen address
+func (m *Manager) Addr() string { return m.ln.Addr().String() }
+
+// A Session that shares the manager's DHT, with its own copy of the config
+func (m *Manager) newSession(edit func(*Config)) *Session {
+	cfg := *m.cfg
+	edit(&cfg)
+	return &Session{cfg: &cfg, DHT: m.DHT, peerID: m.peerID, thr: m.thr, limits: newLimits(0, 0)}
+}
+
+// Starts seeding the file or directory at *path*
+func (m *Manager) AddSeed(path string) (*Session, error) {
+	sess := m.newSession(func(c *Config) { c.SeedPath = path })
+	if err := sess.openSeed(); err != nil {
+		return nil, err
+	}
+	if err := m.register(sess); err != nil {
+		sess.Shutdown()
+		return nil, err
+	}
+	m.start(sess)
+	return sess, nil
+}
+
+// Starts downloading from a .bit/.torrent path or magnet link into *dest*
+// ("" for -dest). The torrent is listed right away; metadata, disk checks
+// and the download run in background.
+func (m *Manager) AddGet(metaPath, dest string) (*Session, error) {
+	sess := m.newSession(func(c *Config) {
+		c.MetaPath = metaPath
+		if dest != "" {
+			c.DestDir = dest
+		}
+	})
+	if metainfo.IsMagnet(metaPath) {
+		ih, name, err := metainfo.ParseMagnet(metaPath)
+		if err != nil {
+			return nil, err
+		}
+		sess.InfoHash, sess.name = ih, name
+	} else {
+		meta, err := metainfo.Load(metaPath)
+		if err != nil {
+			return nil, err
+		}
+		sess.InfoHash = meta.InfoHash()
+	}
+	sess.setState(StateMetadata)
+	if err := m.register(sess); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := sess.openGet(); err != nil {
+			sess.fail(err)
+			logger.Log("torrent_err", map[string]any{
+				"infoHash": hex.EncodeToString(sess.InfoHash[:]),
+				"err":      err.Error(),
+			})
+			return
+		}
+		// Under m.mu: a Remove either comes first or finds the swarm to close
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.torrents[sess.InfoHash] != sess {
+			sess.Shutdown() // removed while starting: Remove had no store to close yet
+			return
+		}
+		if sess.State() == StatePaused {
+			return // Resume starts it
+		}
+		m.start(sess)
+	}()
+	return sess, nil
+}
+
+func (m *Manager) register(sess *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.torrents[sess.InfoHash]; ok {
+		return ErrDuplicate
+	}
+	m.torrents[sess.InfoHash] = sess
+	logger.Log("torrent_added", map[string]any{"infoHash": hex.EncodeToString(sess.InfoHash[:])})
+	return nil
+}
+
+// Fresh swarm, announce, and the download if anything is missing
+func (m *Manager) start(sess *Session) {
+	sess.startSwarm()
+	go sess.announce(sess.swarm(), m.Addr())
+	if sess.complete() {
+		sess.setState(StateSeeding)
+		return
+	}
+	go sess.download(m.Addr())
+}
+
+// Looks a torrent up by infohash, nil if absent
+func (m *Manager) Get(ih [20]byte) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.torrents[ih]
+}
+
+// All torrents, in no particular order
+func (m *Manager) Torrents() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Session, 0, len(m.torrents))
+	for _, sess := range m.torrents {
+		out = append(out, sess)
+	}
+	return out
+}
+
+// Drops every connection of the torrent and stops downloading; data stays open.
+// The download goroutine saves the resume file once its loop returns.
+func (m *Manager) Pause(ih [20]byte) error {
+	sess := m.Get(ih)
+	if sess == nil {
+		return ErrUnknownTorrent
+	}
+	if !sess.opened() {
+		return ErrNotReady
+	}
+	if sess.State() == StatePaused {
+		return nil
+	}
+	sess.setState(StatePaused)
+	if sw := sess.swarm(); sw != nil {
+		sw.Close()
+	}
+	logger.Log("torrent_paused", map[string]any{"infoHash": hex.EncodeToString(ih[:])})
+	return nil
+}
+
+func (m *Manager) Resume(ih [20]byte) error {
+	sess := m.Get(ih)
+	if sess == nil {
+		return ErrUnknownTorrent
+	}
+	if sess.State() != StatePaused {
+		return nil
+	}
+	sess.setState(StateChecking) // start sets the real state
+	m.start(sess)
+	logger.Log("torrent_resumed", map[string]any{"infoHash": hex.EncodeToString(ih[:])})
+	return nil
+}
+
+// Stops the torrent and forgets it. Downloaded data stays on disk.
+func (m *Manager) Remove(ih [20]byte) error {
+	m.mu.Lock()
+	sess, ok := m.torrents[ih]
+	delete(m.torrents, ih)
+	m.mu.Unlock()
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	if sw := sess.swarm(); sw != nil {
+		sw.Close()
+	}
+	sess.Shutdown()
+	logger.Log("torrent_removed", map[string]any{"infoHash": hex.EncodeToString(ih[:])})
+	return nil
+}
+
+// Stops every torrent, flushing storage and resume files
+func (m *Manager) Close() {
+	m.ln.Close()
+	m.DHT.Close()
+	for _, sess := range m.Torrents() {
+		if sw := sess.swarm(); sw != nil {
+			sw.Close()
+		}
+		sess.Shutdown()
+	}
+}
+
+// Accepts peers on the shared listener until it is closed
+func (m *Manager) Serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Log("accept_err", map[string]any{"err": err.Error()})
+			continue
+		}
+		go m.route(conn)
+	}
+}
+
+// Reads the handshake to learn the infohash, then hands the connection
+// (handshake put back in front) to that torrent's swarm
+func (m *Manager) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(routeTimeout))
+	msg, err := protocol.Decode(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || msg.ID != protocol.MsgHandshake || len(msg.Data) != 40 {
+		logger.Log("route_err", map[string]any{"peer": conn.RemoteAddr().String(), "reason": "bad handshake"})
+		conn.Close()
+		return
+	}
+	var ih [20]byte
+	copy(ih[:], msg.Data[:20])
+	sess := m.Get(ih)
+	var sw *Swarm
+	if sess != nil && sess.State() != StatePaused {
+		sw = sess.swarm()
+	}
+	if sw == nil {
+		logger.Log("route_err", map[string]any{
+			"peer":     conn.RemoteAddr().String(),
+			"infoHash": hex.EncodeToString(ih[:]),
+			"reason":   "unknown or paused torrent",
+		})
+		conn.Close()
+		return
+	}
+
+	var head bytes.Buffer
+	msg.Encode(&head)
+	sw.Accept(&replayConn{Conn: conn, r: io.MultiReader(&head, conn)}, m.peerID)
+}
+
+// A connection whose first bytes were already read once and are served again
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
+
+// Sends *raw* to the manager and returns the first message back,
+// nil if the connection was closed instead
+func firstReply(t *testing.T, addr string, raw []byte) *protocol.Message {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.Decode(c)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("neither answered nor closed")
+		}
+		return nil
+	}
+	return msg
+}
+
+func handshake(ih [20]byte) []byte {
+	var b bytes.Buffer
+	id := protocol.RandomPeerID()
+	msg := protocol.NewHandshake(ih[:], id[:])
+	msg.Encode(&b)
+	return b.Bytes()
+}
+
+func TestManagerRoute(t *testing.T) {
+	m, err := NewManager(&Config{Listen: "127.0.0.1:0", StorageKind: storage.KindFile, MetaFormat: "bit", UploadSlots: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	go m.Serve()
+
+	payload := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(payload, bytes.Repeat([]byte("x"), 100_000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := m.AddSeed(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih := sess.InfoHash
+
+	reply := firstReply(t, m.Addr(), handshake(ih))
+	if reply == nil || reply.ID != protocol.MsgHandshake || !bytes.Equal(reply.Data[:20], ih[:]) {
+		t.Fatalf("known torrent: want its handshake back, got %+v", reply)
+	}
+
+	var other [20]byte
+	other[0] = 1
+	if reply := firstReply(t, m.Addr(), handshake(other)); reply != nil {
+		t.Fatalf("unknown torrent: want closed, got %+v", reply)
+	}
+	if reply := firstReply(t, m.Addr(), []byte("GET / HTTP/1.1\r\n\r\n")); reply != nil {
+		t.Fatalf("garbage: want closed, got %+v", reply)
+	}
+	var have bytes.Buffer
+	msg := protocol.Message{ID: protocol.MsgHave, Data: make([]byte, 4)}
+	msg.Encode(&have)
+	if reply := firstReply(t, m.Addr(), have.Bytes()); reply != nil {
+		t.Fatalf("no handshake first: want closed, got %+v", reply)
+	}
+
+	if err := m.Pause(ih); err != nil {
+		t.Fatal(err)
+	}
+	if reply := firstReply(t, m.Addr(), handshake(ih)); reply != nil {
+		t.Fatalf("paused torrent: want closed, got %+v", reply)
+	}
+	if err := m.Remove(ih); err != nil {
+		t.Fatal(err)
+	}
+	if reply := firstReply(t, m.Addr(), handshake(ih)); reply != nil {
+		t.Fatalf("removed torrent: want closed, got %+v", reply)
+	}
+}
+
+// Removed while openGet runs: the store it opened must still be closed
+// (the resume file is written on close)
+func TestManagerRemoveWhileStarting(t *testing.T) {
+	m, err := NewManager(&Config{Listen: "127.0.0.1:0", StorageKind: storage.KindFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	dir := t.TempDir()
+	h := sha1.Sum(make([]byte, 1000))
+	meta := &metainfo.Meta{FileName: "out.bin", FileLength: 1000, PieceSize: 1024, Hashes: [][]byte{h[:]}}
+	metaPath := filepath.Join(dir, "out.bit")
+	if err := meta.Write(metaPath); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := m.AddGet(metaPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove(sess.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(dir, "out.bin.resume")); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("store never closed")
+		}
+	}
+}
+
+// The control API polls a torrent while openGet finds its data on disk
+func TestManagerStatsWhileChecking(t *testing.T) {
+	m, err := NewManager(&Config{Listen: "127.0.0.1:0", StorageKind: storage.KindFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("abcd"), 1<<15)
+	var hashes [][]byte // many small pieces: a long window for racing reads
+	for off := 0; off < len(data); off += 16 {
+		h := sha1.Sum(data[off : off+16])
+		hashes = append(hashes, h[:])
+	}
+	meta := &metainfo.Meta{FileName: "out.bin", FileLength: int64(len(data)), PieceSize: 16, Hashes: hashes}
+	metaPath := filepath.Join(dir, "out.bit")
+	if err := meta.Write(metaPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "out.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := m.AddGet(metaPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if st := sess.Stats(); st.TotalPieces > 0 && st.Pieces == st.TotalPieces {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("data on disk never counted")
+		}
+	}
+}
+
+// A .bit from before exact lengths: seeding says what to do about it
+func TestManagerSeedOldMeta(t *testing.T) {
+	m, err := NewManager(&Config{Listen: "127.0.0.1:0", StorageKind: storage.KindFile, MetaFormat: "bit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	payload := filepath.Join(t.TempDir(), "payload.bin")
+	data := bytes.Repeat([]byte("x"), 1500)
+	if err := os.WriteFile(payload, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h0, h1 := sha1.Sum(data[:1024]), sha1.Sum(data[1024:])
+	old := &metainfo.Meta{FileName: "payload.bin", FileLength: 2048, PieceSize: 1024, Hashes: [][]byte{h0[:], h1[:]}}
+	if err := old.Write(payload + ".bit"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.AddSeed(payload)
+	if err == nil || !strings.Contains(err.Error(), "re-create") {
+		t.Fatalf("want a re-create hint, got %v", err)
+	}
+
+	// Rebuilt, it seeds
+	if err := os.Remove(payload + ".bit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddSeed(payload); err != nil {
+		t.Fatal(err)
+	}
+}
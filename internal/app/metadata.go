@@ -0,0 +1,131 @@
+// Magnet downloads: fetch the info dict from peers before the normal swarm starts
+
+package app
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+const (
+	metadataTimeout = 15 * time.Second // per peer
+	maxMetadataSize = 8 << 20          // ~400k pieces, anything bigger is hostile
+)
+
+// Resolves a magnet link into Meta: finds peers via DHT (plus -peer),
+// then asks them one by one for the info dict until one passes the hash check.
+func (sess *Session) fetchMetadata(uri string) (*metainfo.Meta, error) {
+	infoHash, name, err := metainfo.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	if sess.DHT == nil && sess.cfg.PeersCSV == "" {
+		return nil, errors.New("magnet link needs dht or -peer")
+	}
+	logger.Log("magnet", map[string]any{"infoHash": hex.EncodeToString(infoHash[:]), "name": name})
+
+	maxTries := 100
+	for range maxTries {
+		candidates := strings.Split(sess.cfg.PeersCSV, ",")
+		candidates = append(candidates, sess.DHT.LookupPeers(infoHash)...)
+		for _, addr := range candidates {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			meta, err := fetchMetadataFrom(addr, infoHash)
+			if err != nil {
+				logger.Log("metadata_err", map[string]any{"peer": addr, "err": err.Error()})
+				continue
+			}
+			logger.Log("metadata_ok", map[string]any{"peer": addr, "name": meta.FileName})
+			return meta, nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return nil, errors.New("no peer delivered metadata")
+}
+
+// One short-lived connection: handshake, request every chunk, verify, hang up.
+func fetchMetadataFrom(addr string, infoHash [20]byte) (*metainfo.Meta, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	type chunkMsg struct {
+		idx, total int
+		data       []byte
+	}
+	chunks := make(chan chunkMsg, 16)
+	done := make(chan struct{})
+	defer close(done) // releases the reader if we bail out early
+	p := peer.New(conn, nil, nil, protocol.RandomPeerID(), infoHash)
+	p.OnMetadata = func(idx, total int, data []byte) {
+		select {
+		case chunks <- chunkMsg{idx, total, data}:
+		case <-done:
+		}
+	}
+	p.Start()
+	p.Send(protocol.NewHandshake(infoHash[:], p.ID[:]))
+	p.Send(protocol.NewMetaRequest(0))
+
+	var (
+		buf      []byte
+		got      []bool // chunks already in buf, resent ones count once
+		received int
+		deadline = time.After(metadataTimeout)
+	)
+	for {
+		select {
+		case c := <-chunks:
+			if c.data == nil {
+				return nil, fmt.Errorf("chunk %d rejected", c.idx)
+			}
+			if buf == nil { // first answer tells the size, ask for the rest
+				if c.total <= 0 || c.total > maxMetadataSize {
+					return nil, fmt.Errorf("bad metadata size %d", c.total)
+				}
+				buf = make([]byte, c.total)
+				got = make([]bool, (c.total+protocol.MetaChunk-1)/protocol.MetaChunk)
+				for i := 1; i*protocol.MetaChunk < c.total; i++ {
+					p.Send(protocol.NewMetaRequest(i))
+				}
+			}
+			start := c.idx * protocol.MetaChunk
+			if c.total != len(buf) || start >= len(buf) ||
+				len(c.data) != min(protocol.MetaChunk, len(buf)-start) {
+				return nil, fmt.Errorf("bad chunk %d", c.idx)
+			}
+			if !got[c.idx] {
+				copy(buf[start:], c.data)
+				got[c.idx] = true
+				received += len(c.data)
+			}
+			if received < len(buf) {
+				continue
+			}
+
+			// Everything is here: it must hash to the infohash we asked for
+			if sum := sha1.Sum(buf); !bytes.Equal(sum[:], infoHash[:]) {
+				return nil, errors.New("metadata hash mismatch")
+			}
+			return metainfo.ParseInfo(buf)
+		case <-deadline:
+			return nil, errors.New("metadata timeout")
+		}
+	}
+}
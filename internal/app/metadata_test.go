@@ -0,0 +1,67 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+// A peer that answers the first metadata request twice must not make
+// the fetch think it has everything
+func TestFetchMetadataResentChunk(t *testing.T) {
+	h := sha1.Sum(nil)
+	meta := &metainfo.Meta{FileName: "big", PieceSize: 1024}
+	for range 1000 { // info dict of two chunks
+		meta.Hashes = append(meta.Hashes, h[:])
+	}
+	meta.FileLength = int64(len(meta.Hashes)) * 1024
+	info := meta.InfoBytes()
+	if len(info) <= protocol.MetaChunk || len(info) > 2*protocol.MetaChunk {
+		t.Fatalf("info dict of %d bytes, want two chunks", len(info))
+	}
+	ih := meta.InfoHash()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		id := protocol.RandomPeerID()
+		hs := protocol.NewHandshake(ih[:], id[:])
+		hs.Encode(conn)
+		for {
+			msg, err := protocol.Decode(conn)
+			if err != nil {
+				return
+			}
+			if msg.ID != protocol.MsgMetaRequest {
+				continue
+			}
+			chunk := int(binary.BigEndian.Uint32(msg.Data))
+			start := chunk * protocol.MetaChunk
+			reply := protocol.NewMetaData(chunk, len(info), info[start:min(start+protocol.MetaChunk, len(info))])
+			reply.Encode(conn)
+			if chunk == 0 {
+				reply.Encode(conn)
+			}
+		}
+	}()
+
+	got, err := fetchMetadataFrom(ln.Addr().String(), ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHash() != ih {
+		t.Fatal("wrong metadata")
+	}
+}
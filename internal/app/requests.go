@@ -0,0 +1,83 @@
+// In-flight block requests: deadlines, re-assignment and snubbed peers
+
+package app
+
+import (
+	"slices"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+const (
+	requestTimeout = 20 * time.Second // a block not delivered by then is asked elsewhere
+	snubAfter      = 3                // rounds with timed-out requests before a peer is snubbed
+)
+
+// One outstanding request for a block
+type ask struct {
+	p        *peer.Peer
+	deadline time.Time
+}
+
+func askedBy(asks []ask, p *peer.Peer) bool {
+	return slices.ContainsFunc(asks, func(a ask) bool { return a.p == p })
+}
+
+func dropAsk(asks []ask, p *peer.Peer) []ask {
+	return slices.DeleteFunc(asks, func(a ask) bool { return a.p == p })
+}
+
+// Snubbed peers keep a single request in flight and are refilled last (sw.mu held)
+func (sw *Swarm) snubbed(p *peer.Peer) bool {
+	return sw.missed[p] >= snubAfter
+}
+
+// Max outstanding requests for *p* (sw.mu held)
+func (sw *Swarm) limit(p *peer.Peer) int {
+	if sw.snubbed(p) {
+		return 1
+	}
+	return sw.pipeline
+}
+
+// Withdraws requests past their deadline so the blocks go to somebody else.
+// Returns the cancels to send after unlocking (sw.mu held).
+func (sw *Swarm) expire(now time.Time) map[*peer.Peer][]protocol.Message {
+	cancels := make(map[*peer.Peer][]protocol.Message)
+	for idx, part := range sw.pending {
+		for b, asks := range part.requested {
+			for _, a := range asks {
+				if now.Before(a.deadline) {
+					continue
+				}
+				sw.inflight[a.p]--
+				cancels[a.p] = append(cancels[a.p],
+					protocol.NewCancel(idx, b*protocol.BlockSize, sw.blockLen(idx, b)))
+			}
+			part.requested[b] = slices.DeleteFunc(asks, func(a ask) bool { return !now.Before(a.deadline) })
+		}
+	}
+	for p, msgs := range cancels {
+		sw.missed[p]++
+		logger.Log("request_timeout", map[string]any{
+			"peer":   p.Conn.RemoteAddr().String(),
+			"blocks": len(msgs),
+			"missed": sw.missed[p],
+		})
+		if sw.missed[p] == snubAfter {
+			logger.Log("snubbed", map[string]any{"peer": p.Conn.RemoteAddr().String()})
+		}
+	}
+	return cancels
+}
+
+// A block arrived from *p*: it is alive after all (sw.mu held)
+func (sw *Swarm) delivered(p *peer.Peer) {
+	if sw.snubbed(p) {
+		logger.Log("unsnubbed", map[string]any{"peer": p.Conn.RemoteAddr().String()})
+	}
+	delete(sw.missed, p)
+}
@@ -0,0 +1,106 @@
+// Picking up an interrupted download where it stopped
+
+package app
+
+import (
+	"encoding/hex"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
+
+// Resume-state file lives next to the download
+func (sess *Session) resumePath() string {
+	return sess.outPath + ".resume"
+}
+
+// Fills BF from data already on disk. Trusts the resume file when
+// the payload was not touched since it was saved, otherwise re-hashes.
+func (sess *Session) resume() {
+	if sess.cfg.StorageKind == storage.KindMemory {
+		return // nothing survives a restart in RAM
+	}
+	layout := layoutOf(sess.Meta)
+	infoHex := hex.EncodeToString(sess.InfoHash[:])
+
+	state, err := storage.LoadResume(sess.resumePath())
+	if err != nil {
+		logger.Log("resume_state_err", map[string]any{"err": err.Error()})
+	}
+
+	var have storage.Bitfield
+	if state.Matches(infoHex, sess.outPath, layout) {
+		have = state.Have
+		for i := range have {
+			if have.Has(i) {
+				sess.Store.MarkPiece(i)
+			}
+		}
+		logger.Log("resume_state_loaded", map[string]any{"file": sess.resumePath()})
+	} else {
+		have = storage.Verify(sess.Store, sess.Meta.Hashes)
+	}
+
+	owned := 0
+	sess.Mu.Lock() // the torrent is listed already: Stats reads BF
+	for i := range have {
+		if have.Has(i) {
+			sess.BF.Set(i)
+			owned++
+		}
+	}
+	sess.Mu.Unlock()
+	logger.Log("resume", map[string]any{"pieces": owned, "totalPieces": len(sess.Meta.Hashes)})
+}
+
+// Whether every piece is on disk
+func (sess *Session) complete() bool {
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+	for i := range sess.BF {
+		if !sess.BF.Has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Records verified pieces so the next start can skip hashing
+func (sess *Session) saveResume() {
+	if sess.outPath == "" || sess.Store == nil {
+		return
+	}
+	stamps, err := storage.StampPayload(sess.outPath, layoutOf(sess.Meta))
+	if err == nil {
+		state := &storage.ResumeState{
+			InfoHash: hex.EncodeToString(sess.InfoHash[:]),
+			Have:     append(storage.Bitfield(nil), sess.BF...),
+			Files:    stamps,
+		}
+		err = state.Save(sess.resumePath())
+	}
+	if err != nil {
+		logger.Log("resume_save_err", map[string]any{"err": err.Error()})
+	}
+}
+
+// Flushes storage and leaves a resume file behind. Safe to call twice
+// (deferred in RunLeecher and from the signal handler in main).
+// A no-op until the store is open: whoever is opening it calls again.
+func (sess *Session) Shutdown() {
+	if !sess.opened() {
+		return
+	}
+	sess.closeOnce.Do(func() {
+		if err := sess.Store.Close(); err != nil {
+			logger.Log("store_close_err", map[string]any{"err": err.Error()})
+		}
+		sess.saveResume() // after Close so mtimes are final
+	})
+}
+
+func (sess *Session) opened() bool {
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+	return sess.Store != nil
+}
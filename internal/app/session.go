@@ -1,4 +1,4 @@
-// Owns the torrent's in-memory state
+// Owns the torrent's live state
 
 package app
 
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -28,17 +29,42 @@ type Session struct {
 	// Immutable Metadata
 	InfoHash [20]byte
 	Meta     *metainfo.Meta
-	Pieces   [][]byte         // len == number of pieces
+	Store    storage.Storage  // piece backend, nil until opened
 	BF       storage.Bitfield // which pieces we own
 
 	// subsystems
 	DHT   *DHTService // nil when -dht-listen "" was passed
 	Swarm *Swarm      // might start empty, peers added later
 
+	// Download output (file or root dir), "" when seeding
+	outPath   string
+	closeOnce sync.Once
+
+	peerID [20]byte // ours in every handshake; a remote with it is ourselves
+
+	state   string // one of the State* values, guarded by Mu
+	lastErr string // why we are in StateError, guarded by Mu
+	name    string // display name from the magnet link, until Meta is known
+
+	xfer transfer // byte counters for the control API
+
+	thr    *throttle // global limits, shared with the other torrents of a Manager
+	limits Limits    // this torrent only
+
 	// cfg reference (for subsystems)
 	cfg *Config
 }
 
+// What a torrent is doing right now
+const (
+	StateMetadata    = "metadata"    // fetching the info dict (magnet)
+	StateChecking    = "checking"    // verifying data already on disk
+	StateDownloading = "downloading" // fetching pieces
+	StateSeeding     = "seeding"     // complete, serving others
+	StatePaused      = "paused"
+	StateError       = "error"
+)
+
 // Allocates memory buffers, starts the UDP node
 //
 // It does not open any TCP connections or files yet.
@@ -52,13 +78,17 @@ func NewSession(cfg *Config, meta *metainfo.Meta) (*Session, error) {
 		}
 	} else {
 		s = &Session{
-			Meta:   meta,
-			Pieces: make([][]byte, len(meta.Hashes)),
-			BF:     storage.NewBitfield(len(meta.Hashes)),
-			cfg:    cfg,
+			Meta: meta,
+			BF:   storage.NewBitfield(len(meta.Hashes)),
+			cfg:  cfg,
 		}
 	}
 
+	s.peerID = protocol.RandomPeerID()
+	// A lone torrent: its limits are the global ones
+	s.thr = newThrottle(cfg)
+	s.limits = newLimits(0, 0)
+
 	// UDP layer Boost
 	dhtSvc, err := StartDHT(cfg.DHTListen, cfg.BootstrapCSV)
 	if err != nil {
@@ -70,9 +100,38 @@ func NewSession(cfg *Config, meta *metainfo.Meta) (*Session, error) {
 
 // Seeder path
 func (sess *Session) RunSeeder() error {
+	if err := sess.openSeed(); err != nil {
+		return err
+	}
+
+	// TCP listener
+	ln, err := net.Listen("tcp", sess.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	sess.startSwarm()
+
+	// UDP side: tell the DHT where to find us
+	go sess.announce(sess.swarm(), ln.Addr().String())
+
+	logger.Log(
+		"seeder_ready",
+		map[string]any{
+			"file":     filepath.Clean(sess.cfg.SeedPath),
+			"tcp":      ln.Addr().String(),
+			"infoHash": hex.EncodeToString(sess.InfoHash[:]),
+			"magnet":   metainfo.MagnetURI(sess.InfoHash, sess.Meta.FileName),
+		},
+	)
+	sess.serve(ln)
+	return nil
+}
+
+// Opens the payload at -seed for serving, writing its metainfo on first run
+func (sess *Session) openSeed() error {
 	cfg := sess.cfg
-	dataPath := cfg.SeedPath
-	metaPath := dataPath + ".bit"
+	dataPath := filepath.Clean(cfg.SeedPath)    // file or directory tree
+	metaPath := dataPath + "." + cfg.MetaFormat // .bit or .torrent
 
 	// Load OR create .bit file
 	if sess.Meta == nil { // first run
@@ -80,52 +139,64 @@ func (sess *Session) RunSeeder() error {
 			return err
 		}
 	}
+	// Swarm ID comes from the metadata content, not the file bytes
+	sess.InfoHash = sess.Meta.InfoHash()
 
-	// Load file pieces into RAM
-	logger.Log("piece_cache_load", map[string]any{"file": dataPath})
-	pieces, _, err := storage.Split(dataPath, storage.DefaultPiece)
+	// Pieces are served straight from the payload
+	logger.Log("piece_store_open", map[string]any{"file": dataPath, "backend": cfg.StorageKind})
+	store, err := storage.Open(cfg.StorageKind, dataPath, layoutOf(sess.Meta), false)
 	if err != nil {
 		return err
 	}
-	for i, p := range pieces {
+	sess.Store = store
+	for i := range sess.Meta.Hashes {
 		// Seeder owns everything
-		sess.Pieces[i] = p
 		sess.BF.Set(i)
 	}
+	sess.setState(StateSeeding)
+	return nil
+}
 
-	// UDP listener loop
-	if sess.DHT != nil {
-		infoHash, _ := protocol.InfoHash(metaPath)
-		maxTries := 5
-		for range maxTries {
-			var addresses []string = sess.DHT.Node.RoutingTable.CheckAddresses()
-			if addresses == nil {
-				logger.Log("seeder did not find DHT yet... try again after 5 sec", nil)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			logger.Log("Seeder_announce", map[string]any{"dht": addresses})
-			sess.DHT.Announce(infoHash, cfg.Listen)
-			break
-		}
-	}
-
-	// TCP listener loop
-	peerID := protocol.RandomPeerID()
-	infoHash, _ := protocol.InfoHash(metaPath)
-	sess.InfoHash = infoHash
+// Starts a fresh swarm and its choker (again after a pause)
+func (sess *Session) startSwarm() {
+	sw := NewSwarm(sess, sess.cfg.DestDir, sess.cfg.KeepSeedingSec)
+	sw.StartChoker()
+	sess.Mu.Lock()
+	sess.Swarm = sw
+	sess.Mu.Unlock()
+}
 
-	ln, err := net.Listen("tcp", cfg.Listen)
-	if err != nil {
-		return err
+// Keeps *addr* announced while *sw* runs: as soon as the DHT knows
+// some nodes, then every reannouncePeriod so it never expires on them
+func (sess *Session) announce(sw *Swarm, addr string) {
+	if sess.DHT == nil {
+		return
+	}
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-sw.quit:
+			return
+		case <-time.After(wait):
+		}
+		addresses := sess.DHT.Announce(sess.InfoHash, addr)
+		if addresses == nil {
+			wait = min(max(2*wait, 5*time.Second), reannouncePeriod)
+			logger.Log("announce_retry", map[string]any{"tcp": addr, "in": wait.String()})
+			continue
+		}
+		logger.Log("announce", map[string]any{"dht": addresses, "tcp": addr})
+		wait = reannouncePeriod
 	}
+}
 
-	logger.Log(
-		"seeder_ready",
-		map[string]any{"file": dataPath, "tcp": cfg.Listen, "infoHash": hex.EncodeToString(infoHash[:])},
-	)
+// Accepts peers until the listener is closed
+func (sess *Session) serve(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Log(
 				"accept_err",
@@ -134,14 +205,7 @@ func (sess *Session) RunSeeder() error {
 			continue
 		}
 		// One goroutine per remote peer
-		go func(c net.Conn) {
-			p := newPeerAsSeeder(c, sess.BF, peerID, sess.Pieces, infoHash)
-			logger.Log(
-				"new_leecher",
-				map[string]any{"peer": c.RemoteAddr().String()},
-			)
-			_ = p // peer goroutine handles traffic, nothing to do
-		}(conn)
+		go sess.Swarm.Accept(conn, sess.peerID)
 	}
 }
 
@@ -151,50 +215,70 @@ func (sess *Session) ensureMeta(dataPath, metaPath string) error {
 	if sess.Meta != nil {
 		return nil
 	}
+	// One made earlier by `create` wins, in either format
+	other := dataPath + ".bit"
+	if strings.HasSuffix(metaPath, ".bit") {
+		other = dataPath + ".torrent"
+	}
+	if !util.Exists(metaPath) && util.Exists(other) {
+		metaPath = other
+	}
 	if util.Exists(metaPath) {
 		m, err := metainfo.Load(metaPath)
 		if err != nil {
 			return err
 		}
+		if err := checkOldMeta(dataPath, metaPath, m); err != nil {
+			return err
+		}
 		sess.Meta = m
-		sess.Pieces = make([][]byte, len(m.Hashes))
 		sess.BF = storage.NewBitfield(len(m.Hashes))
 		return nil
 	}
 
-	// Otherwise create a metafile
-	pieces, hashes, err := storage.Split(dataPath, storage.DefaultPiece)
+	// Otherwise create a metafile (hashing piece by piece, not whole file in RAM)
+	meta, err := BuildMeta(dataPath, MetaOptions{})
 	if err != nil {
 		return err
 	}
-	meta := &metainfo.Meta{
-		FileName:   filepath.Base(dataPath),
-		FileLength: int64(len(pieces) * storage.DefaultPiece),
-		PieceSize:  storage.DefaultPiece,
-		Hashes:     hashes,
-	}
-	if err := meta.Write(metaPath); err != nil {
+	if err := WriteMeta(meta, metaPath); err != nil {
 		return err
 	}
 	logger.Log("meta_write", map[string]any{"file": metaPath})
 	sess.Meta = meta
 
 	// Also Update other fields
-	sess.Pieces = make([][]byte, len(meta.Hashes))
 	sess.BF = storage.NewBitfield(len(meta.Hashes))
 
 	return nil
 }
 
-// Helper to wrap peer.New with seeder-specific fields.
-func newPeerAsSeeder(c net.Conn, bf storage.Bitfield, id [20]byte,
-	allPieces [][]byte, infoHash [20]byte) *peer.Peer {
+// Early versions wrote a single file's length rounded up to whole pieces
+// (but hashed the short last piece), which no payload can match. Such a
+// metainfo can't be fixed in place: its infohash covers the wrong length.
+func checkOldMeta(dataPath, metaPath string, m *metainfo.Meta) error {
+	info, err := os.Stat(dataPath)
+	if err != nil || info.IsDir() || m.IsMultiFile() {
+		return nil // the storage layer reports these
+	}
+	size, piece := info.Size(), int64(m.PieceSize)
+	if size < m.FileLength && m.FileLength%piece == 0 && m.FileLength-size < piece {
+		return fmt.Errorf("%s says %d bytes but %s has %d: it was made by an older version "+
+			"that rounded the length up to whole pieces; delete it and seed again "+
+			"(or run create) to re-create it", metaPath, m.FileLength, dataPath, size)
+	}
+	return nil
+}
 
-	p := peer.New(c, bf, id, infoHash) // Spawn threads btw
-	p.Pieces = allPieces
+// Helper to wrap peer.New for inbound connections.
+// Our bitfield follows when the swarm adds the peer.
+func newPeerAsSeeder(c net.Conn, id [20]byte,
+	store storage.Storage, meta *metainfo.Meta, infoHash [20]byte) *peer.Peer {
+
+	// Meta also lets magnet leechers fetch the info dict
+	p := peer.New(c, meta, store, id, infoHash) // started by Swarm.AddPeer
 	logger.Log("send_handshake", map[string]any{"infoHash": hex.EncodeToString(infoHash[:])})
-	p.SendCh <- protocol.NewHandshake(infoHash[:], id[:])
-	p.SendCh <- protocol.NewBitfield(bf)
+	p.Send(protocol.NewHandshake(infoHash[:], id[:]))
 	return p
 }
 
@@ -205,9 +289,57 @@ func newPeerAsSeeder(c net.Conn, bf storage.Bitfield, id [20]byte,
 // Runs leecher. Will seed after getting a file if specified.
 func (sess *Session) RunLeecher() error {
 	cfg := sess.cfg
+	// Before openGet: without a way to find peers the output isn't worth allocating
+	if sess.DHT == nil && cfg.PeersCSV == "" {
+		return errors.New("get needs dht or -peer")
+	}
+	if err := sess.openGet(); err != nil {
+		return err
+	}
+	defer sess.Shutdown()
 
-	// Load .bit
-	meta, err := metainfo.Load(cfg.MetaPath)
+	// Listen and announce from the start: other leechers
+	// can fetch whatever we already have while we download
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.Listen, err)
+	}
+	defer ln.Close()
+	self := ln.Addr().String()
+	sess.startSwarm()
+	go sess.serve(ln)
+	go sess.announce(sess.swarm(), self)
+	logger.Log("leecher", map[string]any{
+		"desired_infoHash": hex.EncodeToString(sess.InfoHash[:]),
+		"tcp":              self,
+	})
+	sess.download(self)
+
+	// Keep serving for a while (the listener is already open)
+	if cfg.KeepSeedingSec > 0 {
+		logger.Log("seeder_ready", map[string]any{
+			"file": sess.Meta.FileName,
+			"tcp":  self})
+		time.Sleep(time.Duration(cfg.KeepSeedingSec) * time.Second)
+		logger.Log("leecher_stopped_seeding", nil)
+	}
+	return nil
+}
+
+// Loads .bit / .torrent (or asks peers for it when given a magnet link),
+// allocates the output and picks up whatever a previous run left behind
+func (sess *Session) openGet() error {
+	cfg := sess.cfg
+	var (
+		meta *metainfo.Meta
+		err  error
+	)
+	sess.setState(StateMetadata)
+	if metainfo.IsMagnet(cfg.MetaPath) {
+		meta, err = sess.fetchMetadata(cfg.MetaPath)
+	} else {
+		meta, err = metainfo.Load(cfg.MetaPath)
+	}
 	if err != nil {
 		logger.Log(
 			"leecher_load_metainfo_err",
@@ -216,114 +348,135 @@ func (sess *Session) RunLeecher() error {
 		return err
 	}
 
-	// Update session fields
+	// Update session fields (the control API may be reading them)
+	sess.Mu.Lock()
 	sess.Meta = meta
-	sess.Pieces = make([][]byte, len(meta.Hashes))
 	sess.BF = storage.NewBitfield(len(meta.Hashes))
+	sess.InfoHash = meta.InfoHash()
+	sess.Mu.Unlock()
 
-	// First goal - find seeders
-	if sess.DHT == nil {
-		return errors.New("specify dht")
+	// Output file is allocated up front, pieces are written as they arrive
+	sess.outPath = filepath.Join(cfg.DestDir, meta.FileName)
+	store, err := storage.Open(cfg.StorageKind, sess.outPath, layoutOf(meta), true)
+	if err != nil {
+		return err
 	}
-	infoHash, _ := protocol.InfoHash(cfg.MetaPath)
-	sess.InfoHash = infoHash
-	logger.Log("leecher", map[string]any{"desired_infoHash": hex.EncodeToString(infoHash[:])})
-
-	// Try 100 times to find seeder
-	maxTries := 100
-	for range maxTries {
-		peers := sess.DHT.LookupPeers(infoHash)
-		if len(peers) == 0 {
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		if len(peers) > 0 {
-			cfg.PeersCSV += "," + strings.Join(peers, ",")
-			logger.Log("leecher_bootstrap", map[string]any{"new_peers": peers})
-			break
-		}
+	sess.Mu.Lock()
+	sess.Store = store
+	sess.Mu.Unlock()
+
+	// Whatever survived a previous run does not need to be fetched again
+	sess.setState(StateChecking)
+	sess.resume()
+	return nil
+}
+
+// Fetches the missing pieces until the file is complete or the swarm
+// is closed (paused), then records progress. *self* is our listen address.
+func (sess *Session) download(self string) {
+	sw := sess.Swarm
+	sw.book.setSelf(self)
+	sw.book.add(strings.Split(sess.cfg.PeersCSV, ",")...)
+	if sess.complete() {
+		logger.Log("complete", map[string]any{"file": sess.outPath, "resumed": true})
+	} else {
+		sess.setState(StateDownloading)
+		stop := make(chan struct{})
+		go sess.discover(sw, stop)
+		sw.Loop() // Blocks until the file is complete
+		close(stop)
 	}
+	sess.saveResume()
+	if sess.complete() {
+		sess.setState(StateSeeding)
+	}
+}
 
-	// TCP side
-	sess.Swarm = NewSwarm(sess, cfg.DestDir, cfg.KeepSeedingSec)
-	sess.Swarm.Dial(cfg.PeersCSV, infoHash)
-	sess.Swarm.Loop() // Blocks until the file is complete
+// Keeps the swarm populated until *stop* closes: asks the DHT for peers
+// every lookupPeriod (lookupRetry while we have none) and (re)dials book
+// addresses once their backoff allows
+func (sess *Session) discover(sw *Swarm, stop <-chan struct{}) {
+	lookup := time.NewTimer(0)
+	defer lookup.Stop()
+	redial := time.NewTicker(redialPeriod)
+	defer redial.Stop()
 
-	// Starts seeding
-	// Code is similar to runSeeder there
-	if cfg.KeepSeedingSec > 0 {
-		if cfg.Listen == ":0" {
-			return errors.New("please, specify exact tcp address in order to seed '-tcp-listen x'")
+	for {
+		for _, a := range sw.book.due(time.Now()) {
+			go sw.dial(a)
 		}
-		errCh := make(chan error, 1)
-
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					errCh <- fmt.Errorf("seeder panic: %v", r)
-				}
-			}()
-
-			logger.Log("seeder_ready", map[string]any{
-				"file": strings.TrimSuffix(filepath.Base(cfg.MetaPath), ".bit"),
-				"tcp":  cfg.Listen})
-
-			// 1. Announce itself for known peers
-			sess.DHT.Announce(infoHash, cfg.Listen)
-
-			// 2. Open TCP listener and serve incoming messages
-			ln, err := net.Listen("tcp", cfg.Listen)
-			if err != nil {
-				errCh <- fmt.Errorf("failed to listen on %s: %w", cfg.Listen, err)
-				return
+		select {
+		case <-stop:
+			return
+		case <-lookup.C:
+			sess.lookupPeers(sw)
+			// Not the book size: our own announce comes back as an address
+			sw.mu.Lock()
+			alone := len(sw.Peers) == 0
+			sw.mu.Unlock()
+			if alone {
+				lookup.Reset(lookupRetry)
+			} else {
+				lookup.Reset(lookupPeriod)
 			}
+		case <-redial.C:
+		}
+	}
+}
 
-			// close listener after n sec
-			go func() {
-				<-time.After(time.Duration(cfg.KeepSeedingSec) * time.Second)
-				ln.Close()
-			}()
-
-			for {
-				conn, err := ln.Accept()
-				if err != nil {
-					// Error via closing due time?
-					if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-						break
-					}
-					logger.Log(
-						"accept_err",
-						map[string]any{"err": err.Error()},
-					)
-					continue
-				}
-
-				// One routine per remote connection
-				go func(c net.Conn) {
-					newPeerAsSeeder(c, sess.BF, protocol.RandomPeerID(), sess.Pieces, infoHash)
-					logger.Log(
-						"new_leecher",
-						map[string]any{"peer": c.RemoteAddr().String()},
-					)
-				}(conn)
-			}
+// One DHT lookup; new addresses land in the book
+func (sess *Session) lookupPeers(sw *Swarm) {
+	peers := sess.DHT.LookupPeers(sess.InfoHash)
+	if n := sw.book.add(peers...); n > 0 {
+		logger.Log("leecher_bootstrap", map[string]any{"new_peers": peers, "new": n})
+	}
+}
 
-			<-time.After(time.Duration(cfg.KeepSeedingSec) * time.Second)
-			logger.Log("leecher_stopped_seeding", nil)
-			errCh <- nil
-		}()
+func (sess *Session) State() string {
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+	return sess.state
+}
 
-		if err := <-errCh; err != nil {
-			return err
-		}
-	}
-	return nil
+func (sess *Session) setState(state string) {
+	sess.Mu.Lock()
+	sess.state = state
+	sess.Mu.Unlock()
+}
+
+// Gives up on the torrent, keeping the reason for the control API
+func (sess *Session) fail(err error) {
+	sess.Mu.Lock()
+	sess.state = StateError
+	sess.lastErr = err.Error()
+	sess.Mu.Unlock()
 }
 
-// Saves data & sets bit
-func (s *Session) MarkPiece(idx int, data []byte) {
+// Current swarm, nil before the first startSwarm
+func (sess *Session) swarm() *Swarm {
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+	return sess.Swarm
+}
+
+// Saves data to disk & sets bit
+func (s *Session) MarkPiece(idx int, data []byte) error {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
-	s.Pieces[idx] = data
+	if err := s.Store.WritePiece(idx, data); err != nil {
+		return err
+	}
 	s.BF.Set(idx)
+	return nil
+}
+
+// Piece geometry of a torrent, as the storage layer sees it
+func layoutOf(meta *metainfo.Meta) storage.Layout {
+	l := storage.Layout{PieceSize: meta.PieceSize, Length: meta.FileLength}
+	if meta.IsMultiFile() {
+		for _, f := range meta.Files {
+			l.Files = append(l.Files, storage.FileEntry{Path: f.Path, Length: f.Length})
+		}
+	}
+	return l
 }
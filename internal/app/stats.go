@@ -0,0 +1,125 @@
+// Per-torrent numbers for the control API: progress, peers, totals and rates
+
+package app
+
+import (
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the manager recomputes transfer rates
+const rateSample = time.Second
+
+// Snapshot of one torrent
+type TorrentStats struct {
+	InfoHash    string  `json:"infoHash"`
+	Name        string  `json:"name"`
+	State       string  `json:"state"`
+	Error       string  `json:"error,omitempty"`
+	Size        int64   `json:"size"`
+	Pieces      int     `json:"pieces"` // verified pieces we have
+	TotalPieces int     `json:"totalPieces"`
+	Progress    float64 `json:"progress"` // 0..1
+	Peers       int     `json:"peers"`
+	Downloaded  int64   `json:"downloaded"` // block bytes, this process only
+	Uploaded    int64   `json:"uploaded"`
+	DownRate    float64 `json:"downRate"` // bytes/s over the last sample
+	UpRate      float64 `json:"upRate"`
+	Ratio       float64 `json:"ratio"`             // uploaded / downloaded, 0 before any download
+	UpLimit     int64   `json:"upLimit,omitempty"` // this torrent's own limits, bytes/s
+	DownLimit   int64   `json:"downLimit,omitempty"`
+}
+
+// Byte counters of peers that already left (live ones are summed on demand).
+// Updated under the swarm lock together with the removal from sw.Peers.
+type transfer struct {
+	upGone   atomic.Int64
+	downGone atomic.Int64
+
+	mu       sync.Mutex // guards the rate sample
+	lastUp   int64
+	lastDown int64
+	lastAt   time.Time
+	upRate   float64
+	downRate float64
+}
+
+// Totals of live and departed peers
+func (sess *Session) totals() (up, down int64, peers int) {
+	up, down = sess.xfer.upGone.Load(), sess.xfer.downGone.Load()
+	sw := sess.swarm()
+	if sw == nil {
+		return up, down, 0
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	// Re-read under the lock: onLeave moves a peer's bytes into *Gone here
+	up, down = sess.xfer.upGone.Load(), sess.xfer.downGone.Load()
+	for _, p := range sw.Peers {
+		up += p.Uploaded()
+		down += p.Downloaded()
+	}
+	return up, down, len(sw.Peers)
+}
+
+// Updates the rates from the totals since the previous call
+func (sess *Session) sampleRates(now time.Time) {
+	up, down, _ := sess.totals()
+	x := &sess.xfer
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.lastAt.IsZero() {
+		if secs := now.Sub(x.lastAt).Seconds(); secs > 0 {
+			x.upRate = float64(up-x.lastUp) / secs
+			x.downRate = float64(down-x.lastDown) / secs
+		}
+	}
+	x.lastUp, x.lastDown, x.lastAt = up, down, now
+}
+
+func (sess *Session) Stats() TorrentStats {
+	sess.Mu.Lock() // openGet fills InfoHash, Meta and BF in while we are listed
+	st := TorrentStats{
+		InfoHash: hex.EncodeToString(sess.InfoHash[:]),
+		Name:     sess.name,
+	}
+	st.State = sess.state
+	st.Error = sess.lastErr
+	if sess.Meta != nil {
+		st.Name = sess.Meta.FileName
+		st.Size = sess.Meta.FileLength
+		st.TotalPieces = len(sess.Meta.Hashes)
+		for i := range sess.BF {
+			if sess.BF.Has(i) {
+				st.Pieces++
+			}
+		}
+	}
+	sess.Mu.Unlock()
+	if st.TotalPieces > 0 {
+		st.Progress = float64(st.Pieces) / float64(st.TotalPieces)
+	}
+
+	st.Uploaded, st.Downloaded, st.Peers = sess.totals()
+	st.UpLimit, st.DownLimit = sess.limits.Up.Rate(), sess.limits.Down.Rate()
+	if st.Downloaded > 0 {
+		st.Ratio = float64(st.Uploaded) / float64(st.Downloaded)
+	}
+	sess.xfer.mu.Lock()
+	st.UpRate, st.DownRate = sess.xfer.upRate, sess.xfer.downRate
+	sess.xfer.mu.Unlock()
+	return st
+}
+
+// Recomputes every torrent's rates once per rateSample, forever
+func (m *Manager) sampleRates() {
+	ticker := time.NewTicker(rateSample)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, sess := range m.Torrents() {
+			sess.sampleRates(now)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package app
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha1"
 	"encoding/hex"
-	"math/rand"
 	"net"
 	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 
@@ -21,88 +23,426 @@ type Swarm struct {
 	Peers []*peer.Peer
 	mu    sync.Mutex
 
-	// state for rarest-first
+	// state for rarest-first, availability is kept up to date by peer events
 	missing      []bool
 	availability []int
-	ticker       *time.Ticker
+	counted      map[*peer.Peer]storage.Bitfield // what each peer contributed to availability
+
+	// block-level download state
+	layout   storage.Layout
+	pipeline int                // max outstanding block requests per peer
+	pending  map[int]*partial   // pieces being assembled, by index
+	inflight map[*peer.Peer]int // outstanding block requests per peer
+	missed   map[*peer.Peer]int // check rounds in a row with timed-out requests
+	endgame  bool               // every missing block is requested, duplicates allowed
+
+	// corrupt data bookkeeping
+	bans     *banList
+	tainted  map[int][]*peer.Peer // who sent data for a piece that failed its hash
+	suspects map[int]*partial     // failed attempts with several senders, judged later
+
+	slots int                   // upload slots handed out by the choker
+	caps  map[*peer.Peer]Limits // each connection's own rate cap
+
+	// where peers can be found, and which connections we made ourselves
+	book   *addrBook
+	dialed map[*peer.Peer]string
 
 	// Specific for each leecher
 	destDir string
 	keepSec int
 
-	isDone chan bool
+	isDone    chan bool
+	quit      chan struct{} // closed by Close
+	closeOnce sync.Once
 }
 
-const tickerPeriod = time.Duration(2 * time.Second)
+// A piece being downloaded block by block, possibly from several peers
+type partial struct {
+	data      []byte
+	requested [][]ask // who was asked for each block (several in endgame)
+	got       []bool
+	from      []*peer.Peer // who delivered each block
+	only      *peer.Peer   // retry of a mixed failure: one sender, so the hash judges it
+	left      int          // blocks not received yet
+}
+
+const (
+	expirePeriod    = 5 * time.Second // how often request deadlines are checked
+	dialTimeout     = 5 * time.Second
+	defaultPipeline = 5
+)
 
 // Creates new swarm taking session
 func NewSwarm(sess *Session, destDir string, keep int) *Swarm {
 	n := len(sess.Meta.Hashes)
 	miss := make([]bool, n)
 	for i := range miss {
-		miss[i] = true
+		miss[i] = !sess.BF.Has(i) // resumed pieces are not missing
+	}
+	pipeline := sess.cfg.Pipeline
+	if pipeline <= 0 {
+		pipeline = defaultPipeline
 	}
 	return &Swarm{
 		Sess:         sess,
 		mu:           sync.Mutex{},
 		missing:      miss,
 		availability: make([]int, n),
+		counted:      make(map[*peer.Peer]storage.Bitfield),
+		layout:       layoutOf(sess.Meta),
+		pipeline:     pipeline,
+		pending:      make(map[int]*partial),
+		inflight:     make(map[*peer.Peer]int),
+		missed:       make(map[*peer.Peer]int),
+		bans:         newBanList(),
+		book:         newAddrBook(),
+		dialed:       make(map[*peer.Peer]string),
+		caps:         make(map[*peer.Peer]Limits),
+		tainted:      make(map[int][]*peer.Peer),
+		suspects:     make(map[int]*partial),
+		slots:        uploadSlots(sess.cfg.UploadSlots),
 		isDone:       make(chan bool, 1),
-		ticker:       time.NewTicker(tickerPeriod),
+		quit:         make(chan struct{}),
 		destDir:      destDir,
 		keepSec:      keep,
 	}
 }
 
-// Dial CSV peers and attach to Swarm
-func (sw *Swarm) Dial(csv string, infoHash [20]byte) {
-	for addr := range strings.SplitSeq(csv, ",") {
-		addr = strings.TrimSpace(addr)
-		if addr == "" {
-			continue
-		}
-		go func(a string) {
-			// Join peer to network
-			conn, err := net.Dial("tcp", a)
-			if err != nil {
-				logger.Log(
-					"dial_err",
-					map[string]any{"peer": a, "err": err.Error()},
-				)
-				return
-			}
-			logger.Log("joined_to_peer", map[string]any{"peer": a})
+// Connects to one address from the book and attaches it to the Swarm.
+// Failures go back to the book, which decides when to try again.
+func (sw *Swarm) dial(a string) {
+	if sw.bans.bannedAddr(a) {
+		logRefused(a, "dial")
+		sw.book.failed(a, "banned")
+		return
+	}
+	// Join peer to network
+	conn, err := net.DialTimeout("tcp", a, dialTimeout)
+	if err != nil {
+		logger.Log(
+			"dial_err",
+			map[string]any{"peer": a, "err": err.Error()},
+		)
+		sw.book.failed(a, "dial")
+		return
+	}
+	logger.Log("joined_to_peer", map[string]any{"peer": a})
+	sw.book.connected(a)
+
+	infoHash := sw.Sess.InfoHash
+	p := peer.New(conn, sw.Sess.Meta, sw.Sess.Store, sw.Sess.peerID, infoHash)
+
+	logger.Log("send_handshake_dial", map[string]any{"infoHash": hex.EncodeToString(infoHash[:])})
+	p.Send(protocol.NewHandshake(infoHash[:], p.ID[:]))
+
+	sw.mu.Lock()
+	sw.dialed[p] = a
+	sw.mu.Unlock()
+	sw.AddPeer(p)
+}
 
-			p := peer.New(conn, sw.Sess.BF, protocol.RandomPeerID(), sw.Sess.InfoHash)
-			p.Meta = sw.Sess.Meta
-			p.Pieces = sw.Sess.Pieces
+// Serves an inbound connection unless its IP is banned
+func (sw *Swarm) Accept(c net.Conn, id [20]byte) {
+	if sw.bans.bannedAddr(c.RemoteAddr().String()) {
+		logRefused(c.RemoteAddr().String(), "accept")
+		c.Close()
+		return
+	}
+	p := newPeerAsSeeder(c, id, sw.Sess.Store, sw.Sess.Meta, sw.Sess.InfoHash)
+	logger.Log(
+		"new_leecher",
+		map[string]any{"peer": c.RemoteAddr().String()},
+	)
+	sw.AddPeer(p) // served once the choker unchokes it
+}
 
-			p.OnHave = func(idx int) { sw.onHave(p, idx) }
+// Stops the swarm (pause/remove): Loop and the choker return,
+// every connection is dropped and new ones are turned away
+func (sw *Swarm) Close() {
+	sw.closeOnce.Do(func() {
+		close(sw.quit)
+		sw.mu.Lock()
+		peers := slices.Clone(sw.Peers)
+		sw.mu.Unlock()
+		for _, p := range peers {
+			p.Conn.Close() // reader exits, onLeave cleans up
+		}
+	})
+}
 
-			logger.Log("send_handshake_dial", map[string]any{"infoHash": hex.EncodeToString(infoHash[:])})
-			p.SendCh <- protocol.NewHandshake(infoHash[:], p.ID[:])
-			p.SendCh <- protocol.NewBitfield(sw.Sess.BF)
+func (sw *Swarm) closed() bool {
+	select {
+	case <-sw.quit:
+		return true
+	default:
+		return false
+	}
+}
 
+// Hooks a connected peer (dialed or accepted, handshake already queued)
+// into piece picking and the choker, sends it our bitfield and starts it
+func (sw *Swarm) AddPeer(p *peer.Peer) {
+	p.Admit = func(id [20]byte) bool {
+		if id == sw.Sess.peerID {
 			sw.mu.Lock()
-			sw.Peers = append(sw.Peers, p)
+			addr, dialed := sw.dialed[p]
 			sw.mu.Unlock()
-		}(addr)
+			if dialed {
+				sw.book.ours(addr)
+			}
+			logger.Log("peer_refused", map[string]any{"peer": p.Conn.RemoteAddr().String(), "stage": "handshake", "reason": "self"})
+			return false
+		}
+		if sw.bans.bannedID(id) {
+			logRefused(p.Conn.RemoteAddr().String(), "handshake")
+			return false
+		}
+		return true
+	}
+	p.OnHave = func(idx int) { sw.onHave(p, idx) }
+	p.OnBitfield = func() { sw.onBitfield(p) }
+	p.OnBlock = func(idx, begin int, data []byte) { sw.onBlock(p, idx, begin, data) }
+	p.OnChoke = func(choked bool) { sw.onChoke(p, choked) }
+	p.OnInterest = func(interested bool) { sw.onInterest(p, interested) }
+
+	// Same lock as the Have broadcast in onBlock: the peer either
+	// sees a piece in this bitfield or gets a Have for it later
+	sw.mu.Lock()
+	if sw.closed() { // checked under mu, so Close can't miss this peer
+		sw.mu.Unlock()
+		p.Conn.Close()
+		return
 	}
+	sw.limitPeer(p)
+	p.Send(protocol.NewBitfield(slices.Clone(sw.Sess.BF)))
+	sw.Peers = append(sw.Peers, p)
+	sw.counted[p] = storage.NewBitfield(len(sw.missing))
+	sw.mu.Unlock()
+	p.Start() // only now: the reader must see every callback above
 }
 
-// Central callback when *any* peer finishes a piece or disconnects
+// Remote sent its bitfield: recount, tell it whether we care, start asking
+func (sw *Swarm) onBitfield(src *peer.Peer) {
+	sw.mu.Lock()
+	sw.recount(src)
+	want := sw.wants(src)
+	sw.mu.Unlock()
+	src.SetInterested(want)
+
+	sw.mu.Lock()
+	reqs := sw.refill(src)
+	sw.mu.Unlock()
+	send(src, reqs)
+}
+
+// Remote announced a piece (or disconnected with idx == -1)
 func (sw *Swarm) onHave(src *peer.Peer, idx int) {
 	if idx == -1 { // Disconnect
-		logger.Log("leave", map[string]any{"peer": src.Conn.RemoteAddr().String()})
+		sw.onLeave(src)
+		return
+	}
+	sw.mu.Lock()
+	seen, ok := sw.counted[src]
+	if !ok || idx >= len(seen) {
+		sw.mu.Unlock()
+		return
+	}
+	if !seen.Has(idx) {
+		seen.Set(idx)
+		sw.availability[idx]++
+	}
+	want := sw.missing[idx]
+	sw.mu.Unlock()
+	if want { // It has something we want now
+		src.SetInterested(true)
+	}
+
+	sw.mu.Lock()
+	reqs := sw.refill(src)
+	sw.mu.Unlock()
+	send(src, reqs)
+}
+
+// Brings availability in line with *p*'s current bitfield (sw.mu held)
+func (sw *Swarm) recount(p *peer.Peer) {
+	seen, ok := sw.counted[p]
+	if !ok {
 		return
 	}
-	if !sw.missing[idx] { // Got a piece that was owned already
+	for i := range seen {
+		has := p.Has(i)
+		if has && !seen.Has(i) {
+			seen.Set(i)
+			sw.availability[i]++
+		} else if !has && seen.Has(i) {
+			seen[i] = 0
+			sw.availability[i]--
+		}
+	}
+}
+
+// Remote choked us: it drops our pending requests, so ask somebody else.
+// Unchoked: start asking.
+func (sw *Swarm) onChoke(src *peer.Peer, choked bool) {
+	logger.Log("choke_recv", map[string]any{"peer": src.Conn.RemoteAddr().String(), "choked": choked})
+	sw.mu.Lock()
+	var batch map[*peer.Peer][]protocol.Message
+	if choked {
+		sw.release(src)
+		batch = sw.refillAll() // freed blocks go to the others right away
+	} else {
+		batch = map[*peer.Peer][]protocol.Message{src: sw.refill(src)}
+	}
+	sw.mu.Unlock()
+	sendAll(batch)
+}
+
+// Remote wants our pieces: unchoke right away if a slot is free,
+// otherwise it waits for the next rechoke
+func (sw *Swarm) onInterest(src *peer.Peer, interested bool) {
+	if !interested || !src.AmChoking() {
 		return
 	}
+	sw.mu.Lock()
+	used := 0
+	for _, p := range sw.Peers {
+		if !p.AmChoking() {
+			used++
+		}
+	}
+	sw.mu.Unlock()
+	if used < sw.slots {
+		src.SetChoking(false)
+	}
+}
+
+// Forget a peer and free the blocks it still owed us
+func (sw *Swarm) onLeave(src *peer.Peer) {
+	logger.Log("leave", map[string]any{"peer": src.Conn.RemoteAddr().String(), "reason": src.Reason()})
+	sw.mu.Lock()
+	if i := slices.Index(sw.Peers, src); i >= 0 {
+		sw.Peers = slices.Delete(sw.Peers, i, i+1)
+		sw.Sess.xfer.upGone.Add(src.Uploaded()) // keep its bytes in the totals
+		sw.Sess.xfer.downGone.Add(src.Downloaded())
+	}
+	delete(sw.caps, src)
+	if seen, ok := sw.counted[src]; ok {
+		for i := range seen {
+			if seen.Has(i) {
+				sw.availability[i]--
+			}
+		}
+		delete(sw.counted, src)
+	}
+	sw.release(src)
+	delete(sw.missed, src)
+	if addr, ok := sw.dialed[src]; ok {
+		delete(sw.dialed, src)
+		sw.book.failed(addr, "dropped") // reconnect later
+	}
+	batch := sw.refillAll()
+	sw.mu.Unlock()
+	sendAll(batch)
+}
 
-	// Mark done
+// Frees the blocks *src* still owes us (sw.mu held)
+func (sw *Swarm) release(src *peer.Peer) {
+	delete(sw.inflight, src)
+	for idx, part := range sw.pending {
+		if part.only == src {
+			delete(sw.pending, idx) // restart the retry with somebody else
+			continue
+		}
+		for b, asked := range part.requested {
+			if !part.got[b] { // someone else will be asked
+				part.requested[b] = dropAsk(asked, src)
+			}
+		}
+	}
+}
+
+// A block arrived: store it, and once the piece is whole
+// verify it, write it to disk and tell everybody
+func (sw *Swarm) onBlock(src *peer.Peer, idx, begin int, data []byte) {
+	sw.mu.Lock()
+	part, ok := sw.pending[idx]
+	b := begin / protocol.BlockSize
+	if !ok || begin%protocol.BlockSize != 0 || b >= len(part.got) ||
+		len(data) != sw.blockLen(idx, b) || (part.only != nil && part.only != src) {
+		sw.mu.Unlock()
+		return // unsolicited, late or malformed
+	}
+	if askedBy(part.requested[b], src) {
+		sw.inflight[src]--
+		part.requested[b] = dropAsk(part.requested[b], src)
+	}
+	sw.delivered(src)
+	var losers []*peer.Peer // endgame: others asked for the same block
+	if !part.got[b] {
+		copy(part.data[begin:], data)
+		part.got[b] = true
+		part.from[b] = src
+		part.left--
+		for _, a := range part.requested[b] {
+			sw.inflight[a.p]--
+			losers = append(losers, a.p)
+		}
+		part.requested[b] = nil
+	}
+
+	var stored, complete bool
+	if part.left == 0 {
+		delete(sw.pending, idx)
+		stored, complete = sw.finishPiece(idx, part)
+	}
+	// The sender and the endgame losers have room for new requests now
+	batch := map[*peer.Peer][]protocol.Message{src: sw.refill(src)}
+	for _, p := range losers {
+		batch[p] = append(batch[p], sw.refill(p)...)
+	}
+	peers := slices.Clone(sw.Peers)
+	var want []bool
+	if stored {
+		for _, p := range peers {
+			want = append(want, sw.wants(p))
+		}
+	}
+	sw.mu.Unlock()
+
+	for _, p := range losers {
+		p.Send(protocol.NewCancel(idx, begin, len(data)))
+	}
+	sendAll(batch)
+	if stored {
+		// Everybody (uploader included) learns we have it,
+		// and peers with nothing else for us hear we lost interest
+		msg := protocol.NewHave(idx)
+		for i, p := range peers {
+			p.Send(msg)
+			p.SetInterested(want[i])
+		}
+	}
+	if complete {
+		outPath := filepath.Join(sw.destDir, sw.Sess.Meta.FileName)
+		logger.Log("complete", map[string]any{"file": outPath})
+		sw.isDone <- true
+	}
+}
+
+// Verifies and stores an assembled piece (sw.mu held).
+// Returns whether it was stored and whether the download is now complete.
+func (sw *Swarm) finishPiece(idx int, part *partial) (bool, bool) {
+	if sum := sha1.Sum(part.data); !bytes.Equal(sum[:], sw.Sess.Meta.Hashes[idx]) {
+		sw.hashFailed(idx, part)
+		return false, false // still missing, will be picked again
+	}
+	if err := sw.Sess.MarkPiece(idx, part.data); err != nil {
+		logger.Log("write_err", map[string]any{"piece": idx, "err": err.Error()})
+		return false, false
+	}
 	sw.missing[idx] = false
-	sw.Sess.BF.Set(idx)
+	sw.convict(idx, part)
 
 	// Check if load is complete
 	done := 0
@@ -111,73 +451,254 @@ func (sw *Swarm) onHave(src *peer.Peer, idx int) {
 			done++
 		}
 	}
-
 	logger.Log("have", map[string]any{"piece": idx, "totalPieces": done})
+	return true, done == len(sw.missing)
+}
 
-	// Broadcast to everyone else
-	have := protocol.NewHave(idx)
-	sw.mu.Lock()
-	for _, p := range sw.Peers {
-		if p != src {
-			p.SendCh <- have
+// A piece failed its hash (sw.mu held). A lone sender is surely guilty and
+// gets a strike now; with several senders we wait for a good copy to tell
+// which blocks were wrong. Either way the piece goes to somebody else next.
+func (sw *Swarm) hashFailed(idx int, part *partial) {
+	var senders []*peer.Peer
+	var names []string
+	for _, p := range part.from {
+		if !slices.Contains(senders, p) {
+			senders = append(senders, p)
+			names = append(names, p.Conn.RemoteAddr().String())
 		}
 	}
-	sw.mu.Unlock()
+	logger.Log("hash_fail", map[string]any{"piece": idx, "peers": names})
 
-	// Finished taking algorithm
-	if done == len(sw.missing) {
-		outPath := filepath.Join(sw.destDir, sw.Sess.Meta.FileName)
-		if err := storage.Join(sw.Sess.Pieces, outPath); err != nil {
-			logger.Log("write_err", map[string]any{"err": err.Error()})
-		} else {
-			logger.Log("complete", map[string]any{"file": outPath})
+	for _, p := range senders {
+		if !slices.Contains(sw.tainted[idx], p) {
+			sw.tainted[idx] = append(sw.tainted[idx], p)
 		}
-		sw.isDone <- true
 	}
+	if len(senders) == 1 {
+		sw.strike(senders[0], idx)
+	} else {
+		sw.suspects[idx] = part
+	}
+}
+
+// The piece finally verified: senders of blocks that differ
+// from the good copy were the ones lying (sw.mu held)
+func (sw *Swarm) convict(idx int, good *partial) {
+	bad, ok := sw.suspects[idx]
+	delete(sw.suspects, idx)
+	delete(sw.tainted, idx)
+	if !ok {
+		return
+	}
+	var guilty []*peer.Peer
+	for b := range bad.from {
+		lo := b * protocol.BlockSize
+		hi := lo + sw.blockLen(idx, b)
+		if !bytes.Equal(bad.data[lo:hi], good.data[lo:hi]) && !slices.Contains(guilty, bad.from[b]) {
+			guilty = append(guilty, bad.from[b])
+		}
+	}
+	for _, p := range guilty {
+		sw.strike(p, idx)
+	}
+}
 
-	// Ask for a new piece
-	next := sw.choosePiece()
-	if next != -1 {
-		sw.request(next)
+// Counts a failure against *p*. Once it is banned, every connection
+// from its IP or peer ID is dropped (sw.mu held).
+func (sw *Swarm) strike(p *peer.Peer, idx int) {
+	if !sw.bans.strike(p, idx) {
+		return
 	}
+	ip := hostOf(p.Conn.RemoteAddr().String())
+	for _, other := range sw.Peers {
+		if other == p || other.RemoteID == p.RemoteID ||
+			hostOf(other.Conn.RemoteAddr().String()) == ip {
+			other.Conn.Close() // reader exits, onLeave cleans up
+		}
+	}
+	p.Conn.Close()
 }
 
-// Start rarest-first loop (blocking)
+// Whether *p* sent bad data for *idx* before while a clean peer also has it
+// (sw.mu held). If nobody else has it, the tainted peer may try again.
+func (sw *Swarm) avoid(p *peer.Peer, idx int) bool {
+	tainted := sw.tainted[idx]
+	if !slices.Contains(tainted, p) {
+		return false
+	}
+	for _, other := range sw.Peers {
+		if other.Has(idx) && !slices.Contains(tainted, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocks until the download completes. Requests are driven by peer events
+// (bitfield, have, unchoke, block arrival, disconnect); this loop only
+// takes back requests that missed their deadline.
 func (sw *Swarm) Loop() {
+	ticker := time.NewTicker(expirePeriod)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-sw.ticker.C:
-			idx := sw.choosePiece()
-			if idx == -1 {
-				continue
-			}
-			sw.request(idx)
+		case <-ticker.C:
+			sw.mu.Lock()
+			cancels := sw.expire(time.Now())
+			batch := sw.refillAll()
+			sw.mu.Unlock()
+			sendAll(cancels)
+			sendAll(batch)
 		case <-sw.isDone:
-			sw.ticker.Stop()
+			return
+		case <-sw.quit:
 			return
 		}
 	}
 }
 
-// Return rarest piece index by computing availability
-func (sw *Swarm) choosePiece() int {
-	for i := range sw.availability {
-		sw.availability[i] = 0
+// Refills every peer, healthy ones first so slow peers
+// don't get freed blocks straight back (sw.mu held)
+func (sw *Swarm) refillAll() map[*peer.Peer][]protocol.Message {
+	peers := slices.Clone(sw.Peers)
+	slices.SortStableFunc(peers, func(a, b *peer.Peer) int {
+		return cmp.Compare(sw.missed[a], sw.missed[b])
+	})
+	batch := make(map[*peer.Peer][]protocol.Message)
+	for _, p := range peers {
+		if reqs := sw.refill(p); len(reqs) > 0 {
+			batch[p] = reqs
+		}
 	}
-	sw.mu.Lock()
-	// Here available peers bitfield compared
-	for _, p := range sw.Peers {
-		for i := range sw.availability {
-			if p.Bitfield.Has(i) {
-				sw.availability[i]++
+	return batch
+}
+
+// Whether *p* has any piece we still miss (sw.mu held)
+func (sw *Swarm) wants(p *peer.Peer) bool {
+	for i, need := range sw.missing {
+		if need && p.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tops up *p* to `pipeline` outstanding block requests (sw.mu held).
+// Returns the requests; the caller sends them after unlocking.
+// Nothing is asked until *p* unchokes us and knows we are interested.
+func (sw *Swarm) refill(p *peer.Peer) []protocol.Message {
+	var reqs []protocol.Message
+	if p.PeerChoking() || !p.AmInterested() {
+		return nil
+	}
+	deadline := time.Now().Add(requestTimeout)
+	for sw.inflight[p] < sw.limit(p) {
+		idx, b := sw.nextBlock(p)
+		if idx == -1 && sw.inEndgame() {
+			idx, b = sw.duplicateBlock(p)
+		}
+		if idx == -1 {
+			break
+		}
+		sw.pending[idx].requested[b] = append(sw.pending[idx].requested[b], ask{p, deadline})
+		sw.inflight[p]++
+		reqs = append(reqs, protocol.NewRequest(idx, b*protocol.BlockSize, sw.blockLen(idx, b)))
+	}
+	return reqs
+}
+
+// Picks the next block to ask *p* for: finish started pieces first,
+// then start the rarest missing piece it has. Returns -1 if nothing fits.
+func (sw *Swarm) nextBlock(p *peer.Peer) (int, int) {
+	for idx, part := range sw.pending {
+		if !sw.canAsk(p, idx, part) {
+			continue
+		}
+		for b := range part.requested {
+			if len(part.requested[b]) == 0 && !part.got[b] {
+				return idx, b
 			}
 		}
 	}
-	sw.mu.Unlock()
 
+	idx := sw.choosePiece(p)
+	if idx == -1 {
+		return -1, 0
+	}
+	_, size, _ := sw.layout.Bounds(idx)
+	blocks := (size + protocol.BlockSize - 1) / protocol.BlockSize
+	sw.pending[idx] = &partial{
+		data:      make([]byte, size),
+		requested: make([][]ask, blocks),
+		got:       make([]bool, blocks),
+		from:      make([]*peer.Peer, blocks),
+		left:      blocks,
+	}
+	if _, suspect := sw.suspects[idx]; suspect {
+		sw.pending[idx].only = p
+	}
+	logger.Log(
+		"request",
+		map[string]any{"piece": idx, "peer": p.Conn.RemoteAddr().String()},
+	)
+	return idx, 0
+}
+
+// Whether *p* may be asked for blocks of the started piece *idx* (sw.mu held)
+func (sw *Swarm) canAsk(p *peer.Peer, idx int, part *partial) bool {
+	return p.Has(idx) && !sw.avoid(p, idx) && (part.only == nil || part.only == p)
+}
+
+// Endgame starts once every missing block has been asked for: a slow peer
+// holding the last blocks would otherwise stall completion (sw.mu held)
+func (sw *Swarm) inEndgame() bool {
+	left := 0
+	for i, need := range sw.missing {
+		if !need {
+			continue
+		}
+		part, ok := sw.pending[i]
+		if !ok {
+			return false
+		}
+		for b := range part.got {
+			if !part.got[b] && len(part.requested[b]) == 0 {
+				return false
+			}
+		}
+		left++
+	}
+	if !sw.endgame && left > 0 {
+		sw.endgame = true
+		logger.Log("endgame", map[string]any{"pieces": left})
+	}
+	return left > 0
+}
+
+// A block that is already asked from somebody else but not from *p*.
+// Whoever answers first wins, the others get a cancel.
+func (sw *Swarm) duplicateBlock(p *peer.Peer) (int, int) {
+	for idx, part := range sw.pending {
+		if !sw.canAsk(p, idx, part) {
+			continue
+		}
+		for b, asked := range part.requested {
+			if !part.got[b] && !askedBy(asked, p) {
+				return idx, b
+			}
+		}
+	}
+	return -1, 0
+}
+
+// Return rarest piece index *p* can give us (sw.mu held)
+func (sw *Swarm) choosePiece(p *peer.Peer) int {
 	best := -1
 	for i, need := range sw.missing {
-		if !need { // No need to ask available piece
+		if !need || !p.Has(i) || sw.avoid(p, i) { // No need to ask available piece
+			continue
+		}
+		if _, started := sw.pending[i]; started {
 			continue
 		}
 		if best == -1 || sw.availability[i] < sw.availability[best] {
@@ -187,27 +708,21 @@ func (sw *Swarm) choosePiece() int {
 	return best
 }
 
-// Ask random peer to send piece indexed *idx*
-func (sw *Swarm) request(idx int) {
-	sw.mu.Lock()
-	defer sw.mu.Unlock()
-	// For fun I will ask a random peer, not a first one
-	var goodPeers []*peer.Peer
-	for _, p := range sw.Peers {
-		if p.Bitfield.Has(idx) {
-			goodPeers = append(goodPeers, p)
-		}
+// Size of block *b* of piece *idx*; the last block of a piece may be short
+func (sw *Swarm) blockLen(idx, b int) int {
+	_, size, _ := sw.layout.Bounds(idx)
+	return min(protocol.BlockSize, size-b*protocol.BlockSize)
+}
+
+// Sends queued messages to one peer
+func send(p *peer.Peer, msgs []protocol.Message) {
+	for _, m := range msgs {
+		p.Send(m)
 	}
-	if len(goodPeers) == 0 {
-		return // No available peers
+}
+
+func sendAll(batch map[*peer.Peer][]protocol.Message) {
+	for p, msgs := range batch {
+		send(p, msgs)
 	}
-	randomPeerIdx := rand.Intn(len(goodPeers))
-	chosenPeer := goodPeers[randomPeerIdx]
-	
-	// Send request
-	chosenPeer.SendCh <- protocol.NewRequest(idx)
-	logger.Log(
-		"request",
-		map[string]any{"piece": idx, "peer": chosenPeer.Conn.RemoteAddr().String()},
-	)
 }
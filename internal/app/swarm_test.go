@@ -0,0 +1,157 @@
+package app
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/peer"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
+
+// The other end of a swarm connection, scripted by the test
+type remote struct {
+	t    *testing.T
+	conn net.Conn
+	got  chan *protocol.Message // everything the swarm sent us
+}
+
+// Connects a remote that has every piece to *sw*
+func connectRemote(t *testing.T, sw *Swarm, addr string) (*remote, *peer.Peer) {
+	tcp, _ := net.ResolveTCPAddr("tcp", addr)
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { ours.Close(); theirs.Close() })
+	r := &remote{t: t, conn: theirs, got: make(chan *protocol.Message, 64)}
+	go func() {
+		for {
+			msg, err := protocol.Decode(theirs)
+			if err != nil {
+				return
+			}
+			r.got <- msg
+		}
+	}()
+
+	p := peer.New(addrConn{ours, tcp}, sw.Sess.Meta, sw.Sess.Store, [20]byte{}, sw.Sess.InfoHash)
+	sw.AddPeer(p)
+	id := [20]byte{byte(tcp.Port)}
+	all := storage.NewBitfield(len(sw.Sess.Meta.Hashes))
+	for i := range all {
+		all.Set(i)
+	}
+	r.send(protocol.NewHandshake(sw.Sess.InfoHash[:], id[:]))
+	r.send(protocol.NewBitfield(all))
+	r.send(protocol.NewState(protocol.MsgUnchoke))
+	return r, p
+}
+
+func (r *remote) send(msg protocol.Message) {
+	if err := msg.Encode(r.conn); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Waits for the next message of type *id*, skipping the others
+func (r *remote) expect(id uint8) *protocol.Message {
+	r.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-r.got:
+			if msg.ID == id {
+				return msg
+			}
+		case <-timeout:
+			r.t.Fatalf("no message %d", id)
+		}
+	}
+}
+
+// One piece of two blocks, nothing downloaded yet
+func testSwarm(t *testing.T) (*Swarm, []byte) {
+	data := make([]byte, 2*protocol.BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	h := sha1.Sum(data)
+	meta := &metainfo.Meta{FileName: "x", FileLength: int64(len(data)), PieceSize: len(data), Hashes: [][]byte{h[:]}}
+	cfg := &Config{StorageKind: storage.KindMemory}
+	store, err := storage.Open(storage.KindMemory, "", layoutOf(meta), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := &Session{cfg: cfg, Meta: meta, Store: store, BF: storage.NewBitfield(1),
+		InfoHash: meta.InfoHash(), thr: newThrottle(cfg), limits: newLimits(0, 0)}
+	sw := NewSwarm(sess, t.TempDir(), 0)
+	t.Cleanup(sw.Close)
+	return sw, data
+}
+
+// Both blocks asked from two peers at once: whoever delivers first wins,
+// the other gets a cancel and nothing stays counted in flight
+func TestEndgameCancels(t *testing.T) {
+	sw, data := testSwarm(t)
+	const bs = protocol.BlockSize
+
+	a, pa := connectRemote(t, sw, "10.0.0.1:6881")
+	a.expect(protocol.MsgRequest)
+	a.expect(protocol.MsgRequest)
+
+	// Nothing left to ask for: b gets the same blocks
+	b, pb := connectRemote(t, sw, "10.0.0.2:6881")
+	b.expect(protocol.MsgRequest)
+	b.expect(protocol.MsgRequest)
+	sw.mu.Lock()
+	if !sw.endgame || sw.inflight[pa] != 2 || sw.inflight[pb] != 2 {
+		t.Fatalf("endgame %v, in flight a=%d b=%d", sw.endgame, sw.inflight[pa], sw.inflight[pb])
+	}
+	sw.mu.Unlock()
+
+	a.send(protocol.NewPiece(0, 0, data[:bs]))
+	if c := b.expect(protocol.MsgCancel); string(c.Data) != string(protocol.NewCancel(0, 0, bs).Data) {
+		t.Fatalf("b got the wrong cancel %v", c.Data)
+	}
+	b.send(protocol.NewPiece(0, 0, data[:bs])) // crossed the cancel: ignored
+	b.send(protocol.NewPiece(0, bs, data[bs:]))
+	if c := a.expect(protocol.MsgCancel); string(c.Data) != string(protocol.NewCancel(0, bs, bs).Data) {
+		t.Fatalf("a got the wrong cancel %v", c.Data)
+	}
+
+	select {
+	case <-sw.isDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("piece never completed")
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.inflight[pa] != 0 || sw.inflight[pb] != 0 || len(sw.pending) != 0 || sw.missing[0] {
+		t.Fatalf("left behind: in flight a=%d b=%d, pending %d, missing %v",
+			sw.inflight[pa], sw.inflight[pb], len(sw.pending), sw.missing[0])
+	}
+}
+
+// A remote with our own peer ID is us, whatever address it came from
+func TestSelfConnectionRefused(t *testing.T) {
+	sw, _ := testSwarm(t)
+	sw.Sess.peerID = protocol.RandomPeerID()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { ours.Close(); theirs.Close() })
+	go io.Copy(io.Discard, theirs)
+
+	p := peer.New(ours, sw.Sess.Meta, sw.Sess.Store, sw.Sess.peerID, sw.Sess.InfoHash)
+	sw.AddPeer(p)
+	hs := protocol.NewHandshake(sw.Sess.InfoHash[:], sw.Sess.peerID[:])
+	hs.Encode(theirs)
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to ourselves kept open")
+	}
+	if p.Reason() != peer.ReasonRefused {
+		t.Fatalf("dropped for %q", p.Reason())
+	}
+}
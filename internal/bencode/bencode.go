@@ -0,0 +1,211 @@
+// Minimal bencode codec (BEP 3): byte strings, integers, lists, dictionaries
+
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// Already encoded value, written by Marshal as is
+type RawMessage []byte
+
+var ErrSyntax = errors.New("bencode: syntax error")
+
+// Marshal encodes *v* built from string, []byte, []string, ints,
+// []any, map[string]any and RawMessage. Dictionary keys are written in
+// sorted order, so equal values always produce equal bytes (needed for infohashes).
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v any) error {
+	switch x := v.(type) {
+	case RawMessage:
+		buf.Write(x)
+	case string:
+		buf.WriteString(strconv.Itoa(len(x)))
+		buf.WriteByte(':')
+		buf.WriteString(x)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(x)))
+		buf.WriteByte(':')
+		buf.Write(x)
+	case int:
+		fmt.Fprintf(buf, "i%de", x)
+	case int32:
+		fmt.Fprintf(buf, "i%de", x)
+	case int64:
+		fmt.Fprintf(buf, "i%de", x)
+	case uint32:
+		fmt.Fprintf(buf, "i%de", x)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range x {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range x {
+			_ = encode(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys) // raw byte order, as the spec demands
+		buf.WriteByte('d')
+		for _, k := range keys {
+			_ = encode(buf, k)
+			if err := encode(buf, x[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: cannot encode %T", v)
+	}
+	return nil
+}
+
+// Unmarshal decodes exactly one value; trailing bytes are an error.
+// Values are mapped to Go like this:
+//
+//	byte string -> string   (may hold arbitrary bytes)
+//	integer     -> int64
+//	list        -> []any
+//	dictionary  -> map[string]any
+func Unmarshal(data []byte) (any, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: trailing data at %d", ErrSyntax, d.pos)
+	}
+	return v, nil
+}
+
+// RawField returns the encoded bytes of *key* in the top-level dictionary,
+// exactly as they appear in *data* (e.g. the "info" dict of a .torrent).
+func RawField(data []byte, key string) ([]byte, error) {
+	d := decoder{data: data}
+	if !d.eat('d') {
+		return nil, fmt.Errorf("%w: not a dictionary", ErrSyntax)
+	}
+	for !d.eat('e') {
+		k, err := d.str()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		if _, err := d.value(1); err != nil {
+			return nil, err
+		}
+		if k == key {
+			return data[start:d.pos], nil
+		}
+	}
+	return nil, fmt.Errorf("bencode: key %q not found", key)
+}
+
+// Nesting bound so hostile input cannot blow the stack
+const maxDepth = 64
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) eat(c byte) bool {
+	if d.pos < len(d.data) && d.data[d.pos] == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nesting too deep", ErrSyntax)
+	}
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrSyntax)
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.int('e')
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for !d.eat('e') {
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		for !d.eat('e') {
+			k, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[k] = v
+		}
+		return dict, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, d.pos)
+	}
+}
+
+// Reads digits up to *end* (the leading 'i' is already consumed for integers)
+func (d *decoder) int(end byte) (int64, error) {
+	i := bytes.IndexByte(d.data[d.pos:], end)
+	if i <= 0 {
+		return 0, fmt.Errorf("%w: bad integer at %d", ErrSyntax, d.pos)
+	}
+	n, err := strconv.ParseInt(string(d.data[d.pos:d.pos+i]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad integer at %d", ErrSyntax, d.pos)
+	}
+	d.pos += i + 1
+	return n, nil
+}
+
+// Reads "<len>:<bytes>"
+func (d *decoder) str() (string, error) {
+	n, err := d.int(':')
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > int64(len(d.data)-d.pos) {
+		return "", fmt.Errorf("%w: string length %d out of range", ErrSyntax, n)
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
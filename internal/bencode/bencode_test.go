@@ -0,0 +1,53 @@
+package bencode_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/bencode"
+)
+
+func TestMarshalSortsKeys(t *testing.T) {
+	b, err := bencode.Marshal(map[string]any{
+		"spam": []any{"a", int64(-3)},
+		"cow":  "moo",
+		"raw":  bencode.RawMessage("i7e"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d3:cow3:moo3:rawi7e4:spaml1:ai-3eee"; string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+}
+
+func TestRoundTripAndRawField(t *testing.T) {
+	in := map[string]any{
+		"info": map[string]any{"name": "x", "pieces": "\x00\xff", "piece length": int64(16)},
+		"list": []any{int64(1), []any{}, map[string]any{}},
+	}
+	b, _ := bencode.Marshal(in)
+	out, err := bencode.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip: got %#v", out)
+	}
+
+	raw, err := bencode.RawField(b, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := bencode.Marshal(in["info"]); string(raw) != string(want) {
+		t.Fatalf("raw info %q", raw)
+	}
+}
+
+func TestUnmarshalRejectsGarbage(t *testing.T) {
+	for _, bad := range []string{"", "i12", "5:abc", "l", "d3:keye", "i1ei2e", "x", "99999999999999999999:"} {
+		if _, err := bencode.Unmarshal([]byte(bad)); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Iterative Kademlia lookup: walk towards a target ID by asking the closest
+// nodes we know for nodes even closer, alpha queries at a time
+
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+)
+
+const (
+	alpha     = 3  // parallel queries per round
+	maxRounds = 20 // safety net, lookups converge in a few rounds
+)
+
+// Result of a lookup: the k closest nodes that answered, closest first,
+// and the TCP addresses they know for the target (findPeers only)
+type LookupResult struct {
+	Closest []Peer
+	Peers   []string
+	Tokens  map[string]string // findPeers: announce token of each node that answered, by UDP addr
+}
+
+// Candidate of a lookup
+type contact struct {
+	peer    Peer
+	dist    [20]byte // xor distance to the target
+	queried bool
+	alive   bool // answered our query
+}
+
+// Walks towards *target* with findNode queries
+func (node *DHTNode) FindNode(target [20]byte) LookupResult {
+	return node.lookup(target, "findNode")
+}
+
+// Walks towards *infoHash* with findPeers queries, collecting every seeder
+// address the nodes on the way know, ours included: an announce may have
+// landed on this very node
+func (node *DHTNode) LookupPeers(infoHash [20]byte) LookupResult {
+	return node.lookup(infoHash, "findPeers")
+}
+
+// Rounds of up to alpha parallel queries to the closest not yet queried nodes;
+// silent ones (queryTimeout) are dropped from the lookup.
+// Stops once the k closest known nodes have all been queried: nobody
+// answered with anything closer.
+func (node *DHTNode) lookup(target [20]byte, query string) LookupResult {
+	var (
+		shortlist []*contact
+		known     = map[[20]byte]bool{node.ID: true} // never query ourselves
+		peers     []string
+		tokens    = map[string]string{}
+	)
+	add := func(p Peer) {
+		if known[p.ID] || p.Addr == nil {
+			return
+		}
+		known[p.ID] = true
+		shortlist = append(shortlist, &contact{peer: p, dist: xor(p.ID, target)})
+	}
+	for _, p := range node.RoutingTable.Closest(target, kSize) {
+		add(p)
+	}
+
+	infoHex := hex.EncodeToString(target[:])
+	rounds, asked := 0, 0
+	for ; rounds < maxRounds; rounds++ {
+		// Closest first; only the k closest that may still answer count
+		sort.Slice(shortlist, func(i, j int) bool {
+			return slices.Compare(shortlist[i].dist[:], shortlist[j].dist[:]) < 0
+		})
+		var batch []*contact
+		for i, c := range shortlist {
+			if i >= kSize || len(batch) == alpha {
+				break
+			}
+			if !c.queried {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make([]*Msg, len(batch))
+		var wg sync.WaitGroup
+		for i, c := range batch {
+			c.queried = true
+			asked++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				replies[i] = node.query(c.peer.Addr, Msg{T: query, Info: infoHex})
+			}()
+		}
+		wg.Wait()
+
+		for i, c := range batch {
+			reply := replies[i]
+			if reply == nil {
+				continue
+			}
+			c.alive = true
+			peers = append(peers, reply.TcpList...)
+			if reply.Token != "" {
+				tokens[c.peer.Addr.String()] = reply.Token
+			}
+			for _, p := range parsePeers(reply.DHTPeers) {
+				add(p)
+			}
+		}
+		// Silent nodes make room for the next ones
+		shortlist = slices.DeleteFunc(shortlist, func(c *contact) bool { return c.queried && !c.alive })
+	}
+
+	res := LookupResult{Tokens: tokens}
+	for _, c := range shortlist {
+		if c.alive && len(res.Closest) < kSize {
+			res.Closest = append(res.Closest, c.peer)
+		}
+	}
+	if query == "findPeers" {
+		var local []string
+		node.onDispatch(func() { local = node.seeds.get(infoHex, time.Now()) })
+		peers = append(local, peers...)
+	}
+	res.Peers = deduplicate(peers)
+
+	var closest []string
+	for _, p := range res.Closest {
+		closest = append(closest, p.Addr.String())
+	}
+	logger.Log("dht_lookup", map[string]any{
+		"query":   query,
+		"target":  infoHex,
+		"rounds":  rounds,
+		"asked":   asked,
+		"closest": closest,
+		"peers":   res.Peers,
+	})
+	return res
+}
+
+// Nodes of a reply; malformed entries are skipped
+func parsePeers(list []MsgPeer) []Peer {
+	var out []Peer
+	for _, mp := range list {
+		id, ok := parseID(mp.ID)
+		if !ok {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp4", mp.Addr)
+		if err != nil {
+			continue
+		}
+		out = append(out, Peer{ID: id, Addr: addr})
+	}
+	return out
+}
+
+func parseID(s string) (id [20]byte, ok bool) {
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != len(id) {
+		return id, false
+	}
+	copy(id[:], raw)
+	return id, true
+}
+
+// The k closest nodes to *target* we know, as sent in replies
+func (node *DHTNode) closestMsgPeers(target [20]byte) []MsgPeer {
+	var out []MsgPeer
+	for _, p := range node.RoutingTable.Closest(target, kSize) {
+		out = append(out, MsgPeer{ID: hex.EncodeToString(p.ID[:]), Addr: p.Addr.String()})
+	}
+	return out
+}
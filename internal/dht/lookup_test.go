@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Nodes that each know only the next one: nothing but an iterative
+// lookup gets from the first to the last
+func chain(t *testing.T, n int) []*DHTNode {
+	nodes := make([]*DHTNode, n)
+	for i := range nodes {
+		node, err := New("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Close)
+		nodes[i] = node
+	}
+	for i := 0; i+1 < n; i++ {
+		next := nodes[i+1]
+		nodes[i].RoutingTable.Update(Peer{ID: next.ID, Addr: next.addr()})
+	}
+	return nodes
+}
+
+func (node *DHTNode) addr() *net.UDPAddr { return node.Conn.LocalAddr().(*net.UDPAddr) }
+
+func TestLookupPeersWalksTheChain(t *testing.T) {
+	nodes := chain(t, 6)
+	var ih [20]byte
+	ih[0] = 0xAB
+	last := nodes[len(nodes)-1]
+	last.seeds.add(hex.EncodeToString(ih[:]), "10.0.0.1:6881", time.Now())
+
+	res := nodes[0].LookupPeers(ih)
+	if !slices.Equal(res.Peers, []string{"10.0.0.1:6881"}) {
+		t.Fatalf("want the seeder 5 hops away, got %v", res.Peers)
+	}
+}
+
+func TestFindNodeReturnsClosest(t *testing.T) {
+	nodes := chain(t, 6)
+	target := nodes[4].ID
+	target[19] ^= 1 // nodes[4] is the closest, without being the target itself
+
+	res := nodes[0].FindNode(target)
+	if len(res.Closest) != len(nodes)-1 {
+		t.Fatalf("want every other node, got %d", len(res.Closest))
+	}
+	if res.Closest[0].ID != nodes[4].ID {
+		t.Fatalf("closest should be nodes[4]")
+	}
+	for i := 1; i < len(res.Closest); i++ {
+		a, b := xor(res.Closest[i-1].ID, target), xor(res.Closest[i].ID, target)
+		if slices.Compare(a[:], b[:]) > 0 {
+			t.Fatalf("not sorted by distance at %d", i)
+		}
+	}
+}
+
+func TestAnnounceStoresOnClosest(t *testing.T) {
+	nodes := make([]*DHTNode, 2*kSize)
+	for i := range nodes {
+		node, err := New("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Close)
+		nodes[i] = node
+	}
+	self := nodes[0]
+	for _, other := range nodes[1:] {
+		self.RoutingTable.Update(Peer{ID: other.ID, Addr: other.addr()})
+	}
+	var ih [20]byte
+	ih[0] = 0x5A
+	told := self.Announce(ih, "10.0.0.1:6881")
+	if len(told) != kSize {
+		t.Fatalf("want %d nodes told, got %d", kSize, len(told))
+	}
+
+	// Every node is asked directly what it holds
+	infoHex := hex.EncodeToString(ih[:])
+	holders := 0
+	for _, other := range nodes[1:] {
+		reply := self.query(other.addr(), Msg{T: "findPeers", Info: infoHex})
+		if reply == nil {
+			t.Fatal("no reply")
+		}
+		has := len(reply.TcpList) > 0
+		want := slices.ContainsFunc(told, func(p Peer) bool { return p.ID == other.ID })
+		if has != want {
+			t.Fatalf("node holds announcement: %v, was told: %v", has, want)
+		}
+		if has {
+			holders++
+		}
+	}
+	if holders != kSize {
+		t.Fatalf("%d holders", holders)
+	}
+}
+
+// Two nodes: the seeder's announce can only land on the leecher's node,
+// whose own lookup must still find it
+func TestLookupPeersSeesOwnStore(t *testing.T) {
+	nodes := chain(t, 2)
+	leecher, seeder := nodes[0], nodes[1]
+	seeder.RoutingTable.Update(Peer{ID: leecher.ID, Addr: leecher.addr()})
+	var ih [20]byte
+	ih[0] = 0x77
+	if told := seeder.Announce(ih, "[::]:6881"); len(told) != 1 || told[0].ID != leecher.ID {
+		t.Fatalf("announce went to %v", told)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		res := leecher.LookupPeers(ih)
+		if slices.Equal(res.Peers, []string{"127.0.0.1:6881"}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leecher's own lookup found %v", res.Peers)
+		}
+	}
+}
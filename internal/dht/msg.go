@@ -11,12 +11,14 @@ import (
 )
 
 type Msg struct {
-	T        string    `json:"t"`              // ping, pong, announce, findPeers, peers
-	ID       string    `json:"id"`             // hex
-	Info     string    `json:"info,omitempty"` // Hex of infoHash
-	Addr     string    `json:"addr,omitempty"`
+	T        string    `json:"t"`                   // ping, pong, announce, findPeers, peers, findNode, nodes
+	ID       string    `json:"id"`                  // hex
+	TID      string    `json:"tid,omitempty"`       // transaction ID of a query, echoed by its reply
+	Info     string    `json:"info,omitempty"`      // Hex of infoHash (findNode: of the target ID)
+	Addr     string    `json:"addr,omitempty"`      // announce: tcp address, only its port is used
+	Token    string    `json:"token,omitempty"`     // handed out in peers, required by announce
 	TcpList  []string  `json:"tcp_list,omitempty"`  // list of tcp addresses of seeders
-	DHTPeers []MsgPeer `json:"dht_peers,omitempty"` // list of udp addresses of dht nodes
+	DHTPeers []MsgPeer `json:"dht_peers,omitempty"` // list of udp addresses of dht nodes (k closest in nodes/peers)
 }
 
 // Only for messages, I parse it into table.Peer object later
@@ -45,7 +47,7 @@ func send(conn *net.UDPConn, addr *net.UDPAddr, m Msg) error {
 // Reads UDP message and attempt to decode it as Msg.
 func recv(conn *net.UDPConn) (Msg, *net.UDPAddr, error) {
 	var msg Msg
-	buf := make([]byte, 1024)
+	buf := make([]byte, 8192) // a reply with k nodes and many seeders outgrows 1 KiB
 
 	n, addr, err := conn.ReadFromUDP(buf)
 	if err != nil {
@@ -2,27 +2,32 @@ package dht
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
-	"slices"
-
 	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
 )
 
 // DHT node with its id, connection and routingTable
 type DHTNode struct {
-	ID           [20]byte            // Node ID (SHA-1)
-	Conn         *net.UDPConn        // UDP conn for communication
-	RoutingTable *Table              // Contains known peers
-	Seeds        map[string][]string // InfoHash -> []tcpAddr
-	inbox        chan packet         // Channel of incoming UDP messages
-
-	// Same inbox, but for different messages type that need to be isolated
-	inboxPeer chan packet
+	ID           [20]byte      // Node ID (SHA-1)
+	Conn         *net.UDPConn  // UDP conn for communication
+	RoutingTable *Table        // Contains known peers
+	seeds        seedStore     // Announcements we keep for others
+	tokens       *tokens       // Required to announce to us
+	inbox        chan packet   // Channel of incoming UDP messages
+	calls        chan func()   // run by the dispatch goroutine, see onDispatch
+	quit         chan struct{} // closed by Close
+	closeOnce    sync.Once
+
+	mu      sync.Mutex
+	pending map[string]*request // our queries waiting for a reply, by transaction ID
+	lastTID uint32
 }
 
 type packet struct {
@@ -48,9 +53,13 @@ func New(listen string) (*DHTNode, error) {
 		ID:           id,
 		Conn:         conn,
 		RoutingTable: NewTable(id),
-		Seeds:        make(map[string][]string),
+		seeds:        make(seedStore),
+		tokens:       newTokens(time.Now()),
 		inbox:        make(chan packet, 32),
-		inboxPeer:    make(chan packet, 8),
+		calls:        make(chan func()),
+		quit:         make(chan struct{}),
+		pending:      make(map[string]*request),
+		lastTID:      randomTID(),
 	}
 
 	logger.Log(
@@ -64,29 +73,64 @@ func New(listen string) (*DHTNode, error) {
 	return node, nil
 }
 
+// Stops the node: the socket is closed and both loops return.
+// Queries still running give up as if nobody answered.
+func (node *DHTNode) Close() {
+	node.closeOnce.Do(func() {
+		close(node.quit)
+		node.Conn.Close()
+	})
+}
+
 // 1. Single UDP reader goroutine
 func (node *DHTNode) udpLoop() {
 	for {
 		msg, adr, err := recv(node.Conn)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Log("UDP_recv_error", map[string]any{"error": err.Error()})
 			continue // Silently ignore incoming errors
 		}
-		node.inbox <- packet{msg, adr}
+		select {
+		case node.inbox <- packet{msg, adr}:
+		case <-node.quit:
+			return
+		}
 	}
 }
 
 func (node *DHTNode) dispatchLoop() {
-	for p := range node.inbox {
-		// Need to handle peers isolated
-		if p.msg.T == "peers" {
-			node.inboxPeer <- p
-		} else {
+	sweep := time.NewTicker(sweepPeriod)
+	defer sweep.Stop()
+	for {
+		select {
+		case p := <-node.inbox:
 			node.handle(p.msg, p.adr)
+		case f := <-node.calls:
+			f()
+		case <-node.quit:
+			return
+		case now := <-sweep.C:
+			if n := node.seeds.expire(now); n > 0 {
+				logger.Log("dht_seeds_expired", map[string]any{"count": n})
+			}
 		}
 	}
 }
 
+// Runs *f* on the dispatch goroutine, for state only it may touch
+// (seeds, tokens), and waits for it. Skipped once the node is closed.
+func (node *DHTNode) onDispatch(f func()) {
+	done := make(chan struct{})
+	select {
+	case node.calls <- func() { f(); close(done) }:
+		<-done
+	case <-node.quit:
+	}
+}
+
 func (node *DHTNode) handle(msg Msg, adr *net.UDPAddr) {
 	// Refresh routing table with sender's node-ID
 	if raw, err := hex.DecodeString(msg.ID); err == nil && len(raw) == 20 {
@@ -102,10 +146,11 @@ func (node *DHTNode) handle(msg Msg, adr *net.UDPAddr) {
 		for _, node := range node.RoutingTable.GetNPeers(10) {
 			dhtPeers = append(dhtPeers, MsgPeer{ID: hex.EncodeToString(node.ID[:]), Addr: node.Addr.String()})
 		}
-		
+
 		send(node.Conn, adr, Msg{
-			T: "pong",
-			ID: hex.EncodeToString(node.ID[:]),
+			T:        "pong",
+			ID:       hex.EncodeToString(node.ID[:]),
+			TID:      msg.TID,
 			DHTPeers: dhtPeers,
 		})
 
@@ -118,6 +163,10 @@ func (node *DHTNode) handle(msg Msg, adr *net.UDPAddr) {
 		// LOGGER END
 
 	case "pong":
+		if !node.deliver(msg, adr) {
+			return // not an answer to our ping
+		}
+
 		// take UDP nodes there
 		msgPeers := msg.DHTPeers
 		for _, msgPeer := range msgPeers {
@@ -133,105 +182,93 @@ func (node *DHTNode) handle(msg Msg, adr *net.UDPAddr) {
 			copy(id20[:], rawID)
 
 			peer := Peer{
-				ID: id20,
+				ID:   id20,
 				Addr: udpAddr,
 			}
 			node.RoutingTable.Update(peer)
 		}
 
 	case "announce":
-		if msg.Addr != "" {
-			addTCP(node.Seeds, msg.Info, msg.Addr)
+		// Only the port is taken from the message, the IP is the sender's
+		_, port, err := net.SplitHostPort(msg.Addr)
+		if err != nil || !node.tokens.valid(msg.Token, adr.IP, time.Now()) {
+			logger.Log("dht_announce_refused", map[string]any{"from": adr.String(), "addr": msg.Addr})
+			return
 		}
+		node.seeds.add(msg.Info, net.JoinHostPort(adr.IP.String(), port), time.Now())
 
 		// LOG INFORMATION
 		var out []string
-		for infoHash, peers := range node.Seeds {
+		for infoHash := range node.seeds {
 			out = append(out, fmt.Sprintf("%s: [%s]",
 				infoHash,
-				strings.Join(peers, ", "),
+				strings.Join(node.seeds.get(infoHash, time.Now()), ", "),
 			))
 		}
 		logger.Log("AVAILABLE_SEEDERS", map[string]any{"seeders": out})
 		// LOG END
 
 	case "findPeers":
-		list := slices.Clone(node.Seeds[msg.Info]) // known seeders
-		list = deduplicate(list)
+		list := node.seeds.get(msg.Info, time.Now()) // known live seeders
 		logger.Log("Answer to findPeers", map[string]any{"seeders": list})
 
-		send(node.Conn, adr, Msg{
-			T: "peers", ID: hex.EncodeToString(node.ID[:]),
+		reply := Msg{
+			T: "peers", ID: hex.EncodeToString(node.ID[:]), TID: msg.TID,
 			Info: msg.Info, TcpList: list,
+			Token: node.tokens.issue(adr.IP, time.Now()), // lets the asker announce to us
+		}
+		// No seeders here: point the asker closer to the infohash
+		if target, ok := parseID(msg.Info); ok && len(list) == 0 {
+			reply.DHTPeers = node.closestMsgPeers(target)
+		}
+		send(node.Conn, adr, reply)
+
+	case "findNode":
+		target, ok := parseID(msg.Info)
+		if !ok {
+			return
+		}
+		send(node.Conn, adr, Msg{
+			T: "nodes", ID: hex.EncodeToString(node.ID[:]), TID: msg.TID,
+			Info: msg.Info, DHTPeers: node.closestMsgPeers(target),
 		})
+
+	// Answers to our lookups
+	case "peers", "nodes":
+		node.deliver(msg, adr)
 	}
 }
 
 /// Public Helpers
 
-// Sends a ping message to the given address (expects pong)
-func (node *DHTNode) Ping(addr string) {
-	resolvedAddr, _ := net.ResolveUDPAddr("udp4", addr)
-	send(node.Conn, resolvedAddr, Msg{
-		T:  "ping",
-		ID: hex.EncodeToString(node.ID[:]),
-	})
-}
-
-// Announce tells every known DHT neighbor (UDP) that
-// “I serve infoHash and you can fetch the file from tcpAddr”.
-func (node *DHTNode) Announce(hexInfoHash, tcpContact string) {
-	msg := Msg{
-		T:    "announce",
-		ID:   hex.EncodeToString(node.ID[:]),
-		Info: hexInfoHash,
-		Addr: tcpContact,
-	}
-
-	// Sends this message for each known node
-	for _, bucket := range node.RoutingTable.bucket {
-		for _, peer := range bucket.peers {
-			send(node.Conn, peer.Addr, msg)
-		}
-	}
-}
-
-// Sends a single findPeers query to *bootstrap* and waits
-// up to 500 ms for a corresponding "peers" reply. It returns the list
-// of TCP addresses contained in that reply. (deduplicated by caller)
-func (node *DHTNode) FindPeers(bootstrap string, infoHex string) []string {
-	// 1. Send query
-	adr, err := net.ResolveUDPAddr("udp4", bootstrap)
+// Sends a ping message to the given address and waits for the pong.
+// Nodes listed in it go into the routing table. False if none came.
+func (node *DHTNode) Ping(addr string) bool {
+	resolvedAddr, err := net.ResolveUDPAddr("udp4", addr)
 	if err != nil {
-		logger.Log("findPeers_bad_address", map[string]any{"err": err.Error()})
-		return nil
-	}
-	send(node.Conn, adr, Msg{
-		T:    "findPeers",
-		ID:   hex.EncodeToString(node.ID[:]),
-		Info: infoHex,
-	})
-
-	timeout := time.After(500 * time.Millisecond)
-	for {
-		select {
-		case p := <-node.inboxPeer:
-			// Skip other messages
-			if p.msg.T == "peers" {
-				return p.msg.TcpList
-			}
-		case <-timeout:
-			logger.Log("findPeers_timeout", map[string]any{"bootstrap": bootstrap})
-			return nil
-		}
+		logger.Log("bad_address", map[string]any{"addr": addr, "err": err.Error()})
+		return false
 	}
+	return node.query(resolvedAddr, Msg{T: "ping"}) != nil
 }
 
-func addTCP(store map[string][]string, ih, tcp string) {
-	if slices.Contains(store[ih], tcp) {
-		return
+// Announce tells the k nodes closest to infoHash (UDP) that
+// “I serve infoHash and you can fetch the file from tcpAddr”.
+// Those are where lookups for infoHash end up. Only the port of tcpContact
+// counts: nodes store it with the IP our packets come from.
+// Returns the nodes told.
+func (node *DHTNode) Announce(infoHash [20]byte, tcpContact string) []Peer {
+	res := node.LookupPeers(infoHash) // findPeers replies carry the tokens
+	for _, peer := range res.Closest {
+		send(node.Conn, peer.Addr, Msg{
+			T:     "announce",
+			ID:    hex.EncodeToString(node.ID[:]),
+			Info:  hex.EncodeToString(infoHash[:]),
+			Addr:  tcpContact,
+			Token: res.Tokens[peer.Addr.String()],
+		})
 	}
-	store[ih] = append(store[ih], tcp)
+	return res.Closest
 }
 
 func deduplicate(in []string) []string {
@@ -0,0 +1,101 @@
+// Our queries in flight: each carries a transaction ID that its reply echoes
+
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+)
+
+// How long a query waits for its reply; silent nodes count as gone
+const queryTimeout = 500 * time.Millisecond
+
+// Which reply answers which query
+var replyTo = map[string]string{"ping": "pong", "findNode": "nodes", "findPeers": "peers"}
+
+type request struct {
+	to    string // only the queried address may answer
+	reply string // expected reply type
+	ch    chan Msg
+}
+
+// Sends query *msg* to *addr* and waits up to queryTimeout for its reply,
+// nil if none came. Safe to call from many goroutines at once.
+func (node *DHTNode) query(addr *net.UDPAddr, msg Msg) *Msg {
+	req := &request{to: addr.String(), reply: replyTo[msg.T], ch: make(chan Msg, 1)}
+	msg.ID = hex.EncodeToString(node.ID[:])
+	msg.TID = node.register(req)
+	defer node.forget(msg.TID)
+
+	if err := send(node.Conn, addr, msg); err != nil {
+		return nil
+	}
+	timeout := time.NewTimer(queryTimeout)
+	defer timeout.Stop()
+	select {
+	case reply := <-req.ch:
+		return &reply
+	case <-timeout.C:
+		logger.Log("dht_query_timeout", map[string]any{"to": req.to, "type": msg.T, "tid": msg.TID})
+		return nil
+	}
+}
+
+// Adds *req* to the pending table under a fresh transaction ID
+func (node *DHTNode) register(req *request) string {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for {
+		node.lastTID++
+		tid := tidString(node.lastTID)
+		if _, taken := node.pending[tid]; !taken {
+			node.pending[tid] = req
+			return tid
+		}
+	}
+}
+
+func (node *DHTNode) forget(tid string) {
+	node.mu.Lock()
+	delete(node.pending, tid)
+	node.mu.Unlock()
+}
+
+// Hands a reply to the query it answers. False for replies nobody waits
+// for: unknown or expired ID, wrong type or sender.
+func (node *DHTNode) deliver(msg Msg, from *net.UDPAddr) bool {
+	node.mu.Lock()
+	req, ok := node.pending[msg.TID]
+	if ok && req.to == from.String() && req.reply == msg.T {
+		delete(node.pending, msg.TID) // one reply per query
+	} else {
+		ok = false
+	}
+	node.mu.Unlock()
+
+	if !ok {
+		logger.Log("dht_unexpected_reply", map[string]any{"from": from.String(), "type": msg.T, "tid": msg.TID})
+		return false
+	}
+	req.ch <- msg // buffered, the query reads at most this one
+	return true
+}
+
+// IDs count up from a random start, so replies meant for an
+// earlier run on the same port don't match ours
+func randomTID() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func tidString(n uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return hex.EncodeToString(b[:])
+}
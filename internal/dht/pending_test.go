@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Many queries to one node at once: each gets its own reply
+func TestConcurrentQueries(t *testing.T) {
+	a, b := pair(t)
+	const n = 32
+	infos := make([]string, n)
+	for i := range infos {
+		ih := [20]byte{byte(i)}
+		infos[i] = hex.EncodeToString(ih[:])
+		announce(t, b, a, infos[i], fmt.Sprintf("10.0.0.1:%d", 1000+i))
+	}
+	if !b.Ping(a.addr().String()) { // after the announces: a handled them all
+		t.Fatal("no pong")
+	}
+
+	var wg sync.WaitGroup
+	for i, info := range infos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := b.query(a.addr(), Msg{T: "findPeers", Info: info})
+			want := fmt.Sprintf("127.0.0.1:%d", 1000+i) // the sender's IP
+			if reply == nil || reply.Info != info || len(reply.TcpList) != 1 || reply.TcpList[0] != want {
+				t.Errorf("query %d got %+v", i, reply)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStrayRepliesDropped(t *testing.T) {
+	a, b := pair(t)
+	req := &request{to: a.addr().String(), reply: "peers", ch: make(chan Msg, 1)}
+	tid := b.register(req)
+
+	if b.deliver(Msg{T: "peers", TID: "unknown"}, a.addr()) {
+		t.Fatal("unknown transaction accepted")
+	}
+	if b.deliver(Msg{T: "peers", TID: tid}, b.addr()) {
+		t.Fatal("reply from the wrong address accepted")
+	}
+	if b.deliver(Msg{T: "nodes", TID: tid}, a.addr()) {
+		t.Fatal("reply of the wrong type accepted")
+	}
+	if !b.deliver(Msg{T: "peers", TID: tid}, a.addr()) {
+		t.Fatal("real reply refused")
+	}
+	if b.deliver(Msg{T: "peers", TID: tid}, a.addr()) {
+		t.Fatal("second reply to one query accepted")
+	}
+}
+
+func pair(t *testing.T) (a, b *DHTNode) {
+	a, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Close)
+	b, err = New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return a, b
+}
+
+// Announces *addr* from *from* to *to*, with a token from a findPeers first
+func announce(t *testing.T, from, to *DHTNode, info, addr string) {
+	reply := from.query(to.addr(), Msg{T: "findPeers", Info: info})
+	if reply == nil || reply.Token == "" {
+		t.Fatal("no token")
+	}
+	send(from.Conn, to.addr(), Msg{T: "announce", ID: hex.EncodeToString(from.ID[:]), Info: info, Addr: addr, Token: reply.Token})
+}
+
+func TestClose(t *testing.T) {
+	a, b := pair(t)
+	b.Close()
+	b.Close() // twice is fine
+	if a.query(b.addr(), Msg{T: "ping"}) != nil {
+		t.Fatal("closed node answered")
+	}
+	done := make(chan struct{})
+	go func() {
+		b.LookupPeers([20]byte{1}) // must not wait for the stopped dispatch loop
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lookup on a closed node hangs")
+	}
+}
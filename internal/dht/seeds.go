@@ -0,0 +1,67 @@
+// Announcements a node keeps for others, forgotten unless renewed
+
+package dht
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	AnnounceTTL = 30 * time.Minute // announcers should renew well before this
+	maxSeeds    = 64               // per infohash; the stalest one makes room
+	sweepPeriod = time.Minute      // how often expired announcements are dropped
+)
+
+// InfoHash -> tcpAddr -> time of its last announce.
+// Only touched by the dispatch goroutine.
+type seedStore map[string]map[string]time.Time
+
+// Records (or renews) an announce of *addr* for *infoHash*
+func (s seedStore) add(infoHash, addr string, now time.Time) {
+	addrs := s[infoHash]
+	if addrs == nil {
+		addrs = make(map[string]time.Time)
+		s[infoHash] = addrs
+	}
+	addrs[addr] = now
+	if len(addrs) > maxSeeds {
+		stalest := addr
+		for a, at := range addrs {
+			if at.Before(addrs[stalest]) {
+				stalest = a
+			}
+		}
+		delete(addrs, stalest)
+	}
+}
+
+// Live addresses for *infoHash*, freshest first
+func (s seedStore) get(infoHash string, now time.Time) []string {
+	var out []string
+	for a, at := range s[infoHash] {
+		if now.Sub(at) < AnnounceTTL {
+			out = append(out, a)
+		}
+	}
+	addrs := s[infoHash]
+	slices.SortFunc(out, func(a, b string) int { return addrs[b].Compare(addrs[a]) })
+	return out
+}
+
+// Drops announcements older than AnnounceTTL, returns how many
+func (s seedStore) expire(now time.Time) int {
+	n := 0
+	for ih, addrs := range s {
+		for a, at := range addrs {
+			if now.Sub(at) >= AnnounceTTL {
+				delete(addrs, a)
+				n++
+			}
+		}
+		if len(addrs) == 0 {
+			delete(s, ih)
+		}
+	}
+	return n
+}
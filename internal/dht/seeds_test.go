@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSeedsExpire(t *testing.T) {
+	s := make(seedStore)
+	t0 := time.Now()
+	s.add("ih", "a:1", t0)
+	s.add("ih", "b:1", t0.Add(10*time.Minute))
+
+	if got := s.get("ih", t0.Add(AnnounceTTL)); !slices.Equal(got, []string{"b:1"}) {
+		t.Fatalf("a:1 should have expired, got %v", got)
+	}
+	// Renewed in time: stays
+	s.add("ih", "b:1", t0.Add(AnnounceTTL))
+	if n := s.expire(t0.Add(AnnounceTTL + 10*time.Minute)); n != 1 {
+		t.Fatalf("want 1 expired, got %d", n)
+	}
+	if n := s.expire(t0.Add(3 * AnnounceTTL)); n != 1 || len(s) != 0 {
+		t.Fatalf("want everything gone, expired %d, left %v", n, s)
+	}
+}
+
+func TestSeedsCap(t *testing.T) {
+	s := make(seedStore)
+	t0 := time.Now()
+	for i := range maxSeeds + 1 {
+		s.add("ih", fmt.Sprintf("10.0.0.%d:1", i), t0.Add(time.Duration(i)*time.Second))
+	}
+	got := s.get("ih", t0)
+	if len(got) != maxSeeds {
+		t.Fatalf("want %d seeds, got %d", maxSeeds, len(got))
+	}
+	if slices.Contains(got, "10.0.0.0:1") {
+		t.Fatal("stalest seed should have made room")
+	}
+	if got[0] != fmt.Sprintf("10.0.0.%d:1", maxSeeds) {
+		t.Fatalf("freshest should come first, got %s", got[0])
+	}
+}
@@ -0,0 +1,64 @@
+// Announce tokens: findPeers hands one out, announce must bring it back from
+// the same IP. Nobody can announce for an address they can't receive from.
+
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// A token stays valid for one to two rotations
+const tokenRotation = 5 * time.Minute
+
+// Only touched by the dispatch goroutine
+type tokens struct {
+	secret, previous []byte
+	rotated          time.Time
+}
+
+func newTokens(now time.Time) *tokens {
+	return &tokens{secret: randomSecret(), previous: randomSecret(), rotated: now}
+}
+
+// Token for a requester at *ip*
+func (t *tokens) issue(ip net.IP, now time.Time) string {
+	t.rotate(now)
+	return hex.EncodeToString(sign(t.secret, ip))
+}
+
+// Whether *token* was issued to *ip* under the current or the previous secret
+func (t *tokens) valid(token string, ip net.IP, now time.Time) bool {
+	t.rotate(now)
+	raw, err := hex.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(raw, sign(t.secret, ip)) || hmac.Equal(raw, sign(t.previous, ip))
+}
+
+func (t *tokens) rotate(now time.Time) {
+	switch age := now.Sub(t.rotated); {
+	case age >= 2*tokenRotation: // idle for long: every token out there is stale
+		t.secret, t.previous, t.rotated = randomSecret(), randomSecret(), now
+	case age >= tokenRotation:
+		t.previous, t.secret = t.secret, randomSecret()
+		t.rotated = t.rotated.Add(tokenRotation)
+	}
+}
+
+func sign(secret []byte, ip net.IP) []byte {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(ip.To16())
+	return mac.Sum(nil)[:8]
+}
+
+func randomSecret() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenLifetime(t *testing.T) {
+	t0 := time.Now()
+	tk := newTokens(t0)
+	ip, other := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	tok := tk.issue(ip, t0)
+
+	if !tk.valid(tok, ip, t0) {
+		t.Fatal("fresh token refused")
+	}
+	if tk.valid(tok, other, t0) {
+		t.Fatal("token accepted from another IP")
+	}
+	if !tk.valid(tok, ip, t0.Add(tokenRotation+time.Second)) {
+		t.Fatal("token refused after one rotation")
+	}
+	if tk.valid(tok, ip, t0.Add(2*tokenRotation+time.Second)) {
+		t.Fatal("token accepted after two rotations")
+	}
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	a, b := pair(t)
+	var ih [20]byte
+	info := hex.EncodeToString(ih[:])
+
+	// No token, then a made-up one: both refused
+	send(b.Conn, a.addr(), Msg{T: "announce", ID: hex.EncodeToString(b.ID[:]), Info: info, Addr: "127.0.0.1:7000"})
+	send(b.Conn, a.addr(), Msg{T: "announce", ID: hex.EncodeToString(b.ID[:]), Info: info, Addr: "127.0.0.1:7000", Token: "0011223344556677"})
+	reply := b.query(a.addr(), Msg{T: "findPeers", Info: info})
+	if reply == nil || len(reply.TcpList) != 0 {
+		t.Fatalf("announce without a valid token stored: %+v", reply)
+	}
+
+	// With a token, a claimed foreign IP is replaced by the sender's
+	announce(t, b, a, info, "6.6.6.6:7000")
+	reply = b.query(a.addr(), Msg{T: "findPeers", Info: info})
+	if reply == nil || !slices.Equal(reply.TcpList, []string{"127.0.0.1:7000"}) {
+		t.Fatalf("want the sender's IP with the claimed port, got %+v", reply)
+	}
+}
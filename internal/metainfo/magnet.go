@@ -0,0 +1,61 @@
+// Magnet links: download by infohash, metadata comes from peers
+
+package metainfo
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const magnetPrefix = "magnet:?"
+
+// Whether *s* is a magnet URI rather than a metainfo path
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(s, magnetPrefix)
+}
+
+// Extracts the infohash (and display name, if any) from
+// magnet:?xt=urn:btih:<40 hex | 32 base32>&dn=<name>
+func ParseMagnet(uri string) ([20]byte, string, error) {
+	var infoHash [20]byte
+	if !IsMagnet(uri) {
+		return infoHash, "", errors.New("not a magnet link")
+	}
+	q, err := url.ParseQuery(strings.TrimPrefix(uri, magnetPrefix))
+	if err != nil {
+		return infoHash, "", err
+	}
+	for _, xt := range q["xt"] {
+		btih, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var raw []byte
+		switch len(btih) {
+		case 40:
+			raw, err = hex.DecodeString(btih)
+		case 32:
+			raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(btih))
+		default:
+			err = errors.New("bad btih length")
+		}
+		if err != nil {
+			return infoHash, "", err
+		}
+		copy(infoHash[:], raw)
+		return infoHash, q.Get("dn"), nil
+	}
+	return infoHash, "", errors.New("magnet link has no urn:btih")
+}
+
+// Builds a magnet link that other peers can pass to -get
+func MagnetURI(infoHash [20]byte, name string) string {
+	uri := magnetPrefix + "xt=urn:btih:" + hex.EncodeToString(infoHash[:])
+	if name != "" {
+		uri += "&dn=" + url.QueryEscape(name)
+	}
+	return uri
+}
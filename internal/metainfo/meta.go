@@ -1,16 +1,43 @@
 package metainfo
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Meta struct {
-	FileName   string   `json:"name"`
-	FileLength int64    `json:"length"`
+	FileName   string   `json:"name"`   // file name, or root dir name for multi-file
+	FileLength int64    `json:"length"` // total payload length
 	PieceSize  int      `json:"piece_size"`
-	Hashes     [][]byte `json:"hashes"` // SHA-1 for each piece
+	Hashes     [][]byte `json:"hashes"`            // SHA-1 for each piece
+	Files      []File   `json:"files,omitempty"`   // set only for multi-file torrents
+	Comment    string   `json:"comment,omitempty"` // free text, not part of the infohash
+
+	rawInfo []byte // original bencoded info dict when loaded from a .torrent
+}
+
+// One file inside a multi-file torrent.
+// Pieces run over the files in this order, crossing file boundaries.
+type File struct {
+	Path   string `json:"path"` // slash-separated, relative to FileName dir
+	Length int64  `json:"length"`
+}
+
+// Whether the torrent is a directory tree rather than one file
+func (m *Meta) IsMultiFile() bool {
+	return len(m.Files) > 0
+}
+
+// Size of piece *idx* (the last one may be shorter), 0 if out of range
+func (m *Meta) PieceLen(idx int) int {
+	if idx < 0 || idx >= len(m.Hashes) {
+		return 0
+	}
+	return int(min(int64(m.PieceSize), m.FileLength-int64(idx)*int64(m.PieceSize)))
 }
 
 // Saves the struct as JSON on path file
@@ -22,15 +49,66 @@ func (m *Meta) Write(path string) error {
 	if err := os.WriteFile(path, b, 0o644); err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
-	return nil;
+	return nil
 }
 
-// Parses file back into Meta
+// Parses file back into Meta. Both .bit (JSON) and .torrent (bencode) are accepted.
 func Load(path string) (*Meta, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	if IsTorrent(b) {
+		return ParseTorrent(b)
+	}
 	var m Meta
-	return &m, json.Unmarshal(b, &m)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Consistency of sizes, hashes and names: everything the storage layout
+// and piece math rely on. Both .bit and .torrent/magnet metadata pass here.
+func (m *Meta) validate() error {
+	if err := CheckName(m.FileName); err != nil {
+		return err
+	}
+	if m.PieceSize <= 0 || m.FileLength < 0 {
+		return fmt.Errorf("bad piece size %d or length %d", m.PieceSize, m.FileLength)
+	}
+	numPieces := (m.FileLength + int64(m.PieceSize) - 1) / int64(m.PieceSize)
+	if numPieces != int64(len(m.Hashes)) {
+		return fmt.Errorf("%d hashes for %d bytes", len(m.Hashes), m.FileLength)
+	}
+	for i, h := range m.Hashes {
+		if len(h) != sha1.Size {
+			return fmt.Errorf("hash %d is %d bytes", i, len(h))
+		}
+	}
+	if m.IsMultiFile() {
+		var sum int64
+		for _, f := range m.Files {
+			if f.Length < 0 || f.Path == "" {
+				return fmt.Errorf("bad file entry %q", f.Path)
+			}
+			sum += f.Length
+		}
+		if sum != m.FileLength {
+			return fmt.Errorf("files add up to %d bytes, length is %d", sum, m.FileLength)
+		}
+	}
+	return nil
+}
+
+// The name becomes a file or directory under the download dir, so it must
+// be one plain path element: no separators, "..", or absolute paths
+func CheckName(name string) error {
+	if name == "" || name == "." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return fmt.Errorf("bad name %q", name)
+	}
+	return nil
 }
@@ -0,0 +1,169 @@
+// Standard BitTorrent .torrent files (bencoded, BEP 3)
+
+package metainfo
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/bencode"
+)
+
+// Builds the bencode "info" dictionary describing the payload
+func (m *Meta) InfoDict() map[string]any {
+	pieces := make([]byte, 0, len(m.Hashes)*sha1.Size)
+	for _, h := range m.Hashes {
+		pieces = append(pieces, h...)
+	}
+	info := map[string]any{
+		"name":         m.FileName,
+		"piece length": m.PieceSize,
+		"pieces":       pieces,
+	}
+	if !m.IsMultiFile() {
+		info["length"] = m.FileLength
+		return info
+	}
+	files := make([]any, 0, len(m.Files))
+	for _, f := range m.Files {
+		files = append(files, map[string]any{
+			"length": f.Length,
+			"path":   strings.Split(f.Path, "/"),
+		})
+	}
+	info["files"] = files
+	return info
+}
+
+// SHA-1 over the bencoded info dictionary: the canonical form of the
+// content-defining fields (name, length/files, piece size, hashes).
+// Formatting of a .bit file does not matter, and a .bit and a .torrent
+// of the same payload share one swarm. For a loaded .torrent the original
+// bytes are hashed, so unknown keys (e.g. "private") still count.
+func (m *Meta) InfoHash() [20]byte {
+	if m.rawInfo != nil {
+		return sha1.Sum(m.rawInfo)
+	}
+	raw, _ := bencode.Marshal(m.InfoDict()) // only known types inside
+	return sha1.Sum(raw)
+}
+
+// Bencoded info dictionary, the payload of metadata exchange between peers
+func (m *Meta) InfoBytes() []byte {
+	if m.rawInfo != nil {
+		return m.rawInfo
+	}
+	raw, _ := bencode.Marshal(m.InfoDict())
+	return raw
+}
+
+// Saves Meta as a standard .torrent file
+func (m *Meta) WriteTorrent(path string) error {
+	top := map[string]any{
+		"info":          bencode.RawMessage(m.InfoBytes()),
+		"created by":    "bittorrent",
+		"creation date": time.Now().Unix(),
+	}
+	if m.Comment != "" {
+		top["comment"] = m.Comment
+	}
+	b, err := bencode.Marshal(top)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// Whether *data* looks like a bencoded torrent rather than a JSON .bit file
+func IsTorrent(data []byte) bool {
+	return len(data) > 0 && data[0] == 'd'
+}
+
+// Parses a bencoded .torrent file
+func ParseTorrent(data []byte) (*Meta, error) {
+	raw, err := bencode.RawField(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	if v, err := bencode.Unmarshal(data); err == nil {
+		if top, ok := v.(map[string]any); ok {
+			m.Comment, _ = top["comment"].(string)
+		}
+	}
+	return m, nil
+}
+
+// Builds Meta from a bencoded info dictionary alone
+// (what a .torrent carries, or what peers send over metadata exchange)
+func ParseInfo(raw []byte) (*Meta, error) {
+	v, err := bencode.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent: info is not a dictionary")
+	}
+	m, err := fromInfoDict(info)
+	if err != nil {
+		return nil, err
+	}
+	m.rawInfo = slices.Clone(raw)
+	return m, nil
+}
+
+// Converts a decoded info dictionary into Meta, checking it is consistent
+func fromInfoDict(info map[string]any) (*Meta, error) {
+	name, _ := info["name"].(string)
+	pieceLen, _ := info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	if name == "" || pieceLen <= 0 || len(pieces)%sha1.Size != 0 {
+		return nil, errors.New("torrent: bad name, piece length or pieces")
+	}
+
+	m := &Meta{FileName: name, PieceSize: int(pieceLen)}
+	for i := 0; i < len(pieces); i += sha1.Size {
+		m.Hashes = append(m.Hashes, []byte(pieces[i:i+sha1.Size]))
+	}
+
+	if length, ok := info["length"].(int64); ok {
+		m.FileLength = length
+	} else {
+		files, _ := info["files"].([]any)
+		if len(files) == 0 {
+			return nil, errors.New("torrent: neither length nor files")
+		}
+		for _, item := range files {
+			f, _ := item.(map[string]any)
+			length, _ := f["length"].(int64)
+			parts, _ := f["path"].([]any)
+			var path []string
+			for _, part := range parts {
+				s, _ := part.(string)
+				path = append(path, s)
+			}
+			if length < 0 || len(path) == 0 {
+				return nil, errors.New("torrent: bad file entry")
+			}
+			m.Files = append(m.Files, File{Path: strings.Join(path, "/"), Length: length})
+			m.FileLength += length
+		}
+	}
+
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("torrent: %w", err)
+	}
+	return m, nil
+}
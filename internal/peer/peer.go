@@ -2,94 +2,170 @@ package peer
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
-	"io"
-	"log"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/ratelimit"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
-	"github.com/BitTorrentFileSharing/bittorrent/internal/util"
+)
+
+// Connection timing
+const (
+	handshakeTimeout = 10 * time.Second // from connect to their handshake
+	idleTimeout      = 2 * time.Minute  // silence (keep-alives count) after the handshake
+	keepAlivePeriod  = time.Minute
+	writeTimeout     = 30 * time.Second // one message; longer means they stopped reading
 )
 
 type Peer struct {
 	Conn            net.Conn
-	Bitfield        storage.Bitfield
 	SendCh          chan protocol.Message
-	Meta            *metainfo.Meta
-	Pieces          [][]byte  // Download buffer for leecher
-	ID              [20]byte  // Our ID
-	RemoteID        [20]byte  // Remote ID
-	OnHave          func(int) // Callback into piece picker
+	Meta            *metainfo.Meta                      // nil while fetching it (magnet)
+	Store           storage.Storage                     // Where pieces are read from / written to
+	ID              [20]byte                            // Our ID
+	RemoteID        [20]byte                            // Remote ID
+	OnHave          func(int)                           // Remote has a piece (-1 on disconnect)
+	OnBitfield      func()                              // Remote sent its whole bitfield
+	OnBlock         func(idx, begin int, data []byte)   // Block of a requested piece arrived
+	OnMetadata      func(chunk, total int, data []byte) // Magnet metadata chunk, data == nil if rejected
+	OnChoke         func(choked bool)                   // Remote choked/unchoked us
+	OnInterest      func(interested bool)               // Remote became (not) interested in us
+	Admit           func(remoteID [20]byte) bool        // Checked at handshake, false hangs up
+	UpLimits        []*ratelimit.Limiter                // Piece bytes we send pass all of these
+	DownLimits      []*ratelimit.Limiter                // Piece bytes we receive pass all of these
 	desiredInfohash [20]byte
 	handshakeDone   bool
+	done            chan struct{}    // closed when the reader exits
+	bitfield        storage.Bitfield // what the remote has, see Has
+	bfMu            sync.RWMutex     // the reader writes bitfield, the swarm reads it
+	reason          string           // why it ended, see Reason
+	reasonOnce      sync.Once
+	st              state
+	up              uploadQueue
+
+	// Last piece read for uploading (uploader goroutine only): blocks of one
+	// piece are usually requested back to back, so we hit the disk once per piece
+	cachedIdx   int
+	cachedPiece []byte
+}
+
+// Sets up a connection; nothing is read or written before Start.
+// *meta* and *store* describe the torrent (both nil when only fetching
+// metadata); messages are validated against meta.
+func New(conn net.Conn, meta *metainfo.Meta, store storage.Storage, id, desiredInfohash [20]byte) *Peer {
+	peer := &Peer{Conn: conn, Meta: meta, Store: store, SendCh: make(chan protocol.Message, 16), ID: id, desiredInfohash: desiredInfohash, cachedIdx: -1, done: make(chan struct{})}
+	if meta != nil {
+		peer.bitfield = storage.NewBitfield(len(meta.Hashes)) // empty until their MsgBitfield
+	}
+	peer.st.amChoking.Store(true)
+	peer.st.peerChoking.Store(true)
+	peer.up.ready = make(chan struct{}, 1)
+	return peer
 }
 
-func New(conn net.Conn, bf storage.Bitfield, id, desiredInfohash [20]byte) *Peer {
-	peer := &Peer{Conn: conn, Bitfield: bf, SendCh: make(chan protocol.Message, 16), ID: id, desiredInfohash: desiredInfohash}
+// Starts the connection's goroutines. Callbacks and Admit must be set
+// before: the reader calls them without locking. Messages sent earlier
+// wait in SendCh.
+func (peer *Peer) Start() {
 	go peer.writer()
 	go peer.reader()
-	return peer
+	go peer.uploader()
+}
+
+// Queues a message unless the connection is already gone,
+// so callers never block on a dead peer's full SendCh
+func (peer *Peer) Send(msg protocol.Message) {
+	select {
+	case peer.SendCh <- msg:
+	case <-peer.done:
+	}
 }
 
-// Writes messages into connection
+// Whether the remote has piece *idx*, as far as it told us
+func (peer *Peer) Has(idx int) bool {
+	peer.bfMu.RLock()
+	defer peer.bfMu.RUnlock()
+	return idx >= 0 && idx < len(peer.bitfield) && peer.bitfield.Has(idx)
+}
+
+// Closed once the connection is dead
+func (peer *Peer) Done() <-chan struct{} { return peer.done }
+
+// Writes messages into connection, with a keep-alive every keepAlivePeriod
 func (peer *Peer) writer() {
-	for msg := range peer.SendCh {
+	keepAlive := time.NewTicker(keepAlivePeriod)
+	defer keepAlive.Stop()
+	for {
+		var msg protocol.Message
+		select {
+		case msg = <-peer.SendCh:
+		case <-keepAlive.C:
+			msg = protocol.NewKeepAlive()
+		case <-peer.done:
+			return
+		}
+		peer.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 		if err := msg.Encode(peer.Conn); err != nil {
-			log.Println("Got writer error:", err)
+			peer.drop(ReasonWriteError, err.Error()) // wakes the reader, which closes done
 			return
 		}
 	}
 }
 
-// Reads messages from connection
+// Reads messages from connection until it fails or the remote misbehaves
 func (peer *Peer) reader() {
 	// Leaving callback
 	defer func() {
+		close(peer.done)
 		if peer.OnHave != nil {
 			peer.OnHave(-1)
 		}
 	}()
 
 	for {
+		timeout := idleTimeout
+		if !peer.handshakeDone {
+			timeout = handshakeTimeout
+		}
+		peer.Conn.SetReadDeadline(time.Now().Add(timeout))
 		msg, err := protocol.Decode(peer.Conn)
-		if err == io.EOF {
-			logger.Log(
-				"bye_leecher",
-				map[string]any{"bye": peer.Conn.RemoteAddr().String()},
-			)
+		if err == nil {
+			err = peer.validate(msg)
+		}
+		if err != nil {
+			peer.readFailed(err)
 			return
-		} else if err != nil {
-			logger.Log(
-				"decode_err",
-				map[string]any{"err": err.Error()},
-			)
+		}
+		// Throttle before handling: the remote's next bytes wait in TCP buffers.
+		// Nothing cancels the wait, a closed conn is noticed on the next read.
+		if msg.ID == protocol.MsgPiece {
+			ratelimit.Wait(len(msg.Data), nil, peer.DownLimits...)
+		}
+		if err := peer.handle(msg); err != nil {
+			peer.readFailed(err)
 			return
 		}
-		peer.handle(msg)
 	}
 }
 
-func (peer *Peer) handle(message *protocol.Message) {
-    if !peer.handshakeDone && message.ID != protocol.MsgHandshake {
-        logger.Log("unexpected_message_before_handshake", map[string]any{
-            "peer": peer.Conn.RemoteAddr().String(),
-            "messageID": message.ID,
-        })
-        return
-    }
+// Acts on a validated message. Errors end the connection.
+func (peer *Peer) handle(message *protocol.Message) error {
+	if message.ID == protocol.MsgKeepAlive {
+		return nil // the read deadline moved, that's all
+	}
+	if !peer.handshakeDone && message.ID != protocol.MsgHandshake {
+		return &violation{ReasonBadHandshake, fmt.Sprintf("message %d before handshake", message.ID)}
+	}
 
 	switch message.ID {
 	case protocol.MsgHandshake:
-		if len(message.Data) != 40 {
-			logger.Log("bad_handshake",
-				map[string]any{"peer": peer.Conn.RemoteAddr().String(), "reason": "len"})
-			return
-		}
 		infoHash := message.Data[:20]
 		copy(peer.RemoteID[:], message.Data[20:40])
 
@@ -99,69 +175,121 @@ func (peer *Peer) handle(message *protocol.Message) {
 		})
 
 		if !bytes.Equal(infoHash, peer.desiredInfohash[:]) {
-			logger.Log("infohash_mismatch", nil)
-			peer.Conn.Close()
-			return
+			return &violation{ReasonWrongTorrent, hex.EncodeToString(infoHash)}
+		}
+
+		if peer.Admit != nil && !peer.Admit(peer.RemoteID) {
+			return &violation{ReasonRefused, hex.EncodeToString(peer.RemoteID[:])}
 		}
 
 		peer.handshakeDone = true
 		logger.Log("handshake_ok",
 			map[string]any{"peer": peer.Conn.RemoteAddr().String()})
-		return
 
 	case protocol.MsgBitfield:
-		peer.Bitfield = storage.ParseBitfield(message.Data)
-
-	case protocol.MsgRequest:
-		// I ignore offset/len and always send full piece now
+		if peer.Meta == nil {
+			return nil // metadata fetch, pieces don't matter
+		}
+		peer.bfMu.Lock()
+		peer.bitfield = storage.ParseBitfield(message.Data)
+		peer.bfMu.Unlock()
+		if peer.OnBitfield != nil {
+			peer.OnBitfield()
+		}
 
-		if peer.Pieces == nil {
-			return
+	case protocol.MsgRequest, protocol.MsgCancel:
+		if peer.Store == nil {
+			return nil
+		}
+		r := blockReq{
+			idx:    int(binary.BigEndian.Uint32(message.Data[0:4])),
+			begin:  int(binary.BigEndian.Uint32(message.Data[4:8])),
+			length: int(binary.BigEndian.Uint32(message.Data[8:12])),
+		}
+		if message.ID == protocol.MsgCancel {
+			peer.up.cancel(r)
+			return nil
 		}
-		idx := int(binary.BigEndian.Uint32(message.Data)) // 4-byte index
-		piece := peer.Pieces[idx]
-		resp := protocol.NewPiece(idx, piece)
-		peer.SendCh <- resp
+		if peer.AmChoking() || !peer.Store.HasPiece(r.idx) {
+			return nil // choked peers' requests are dropped
+		}
+		peer.up.push(r) // served by the uploader goroutine
 
 	case protocol.MsgHave:
 		idx := int(binary.BigEndian.Uint32(message.Data))
-		peer.Bitfield.Set(idx)
+		peer.bfMu.Lock()
+		old := peer.Meta == nil || peer.bitfield.Has(idx)
+		if !old {
+			peer.bitfield.Set(idx)
+		}
+		peer.bfMu.Unlock()
+		if old {
+			return nil // old news
+		}
 		if peer.OnHave != nil {
 			peer.OnHave(idx)
 		}
 
-	// Piece came.
-	// Verifies hash and Notifies other peers
+	// Block came. Piece assembly, hash check and
+	// notifying other peers happen in the piece picker
 	case protocol.MsgPiece:
+		if peer.OnBlock == nil {
+			return nil
+		}
 		idx := int(binary.BigEndian.Uint32(message.Data[:4]))
-		data := message.Data[8:] // We skip index+offset
+		begin := int(binary.BigEndian.Uint32(message.Data[4:8]))
+		peer.st.downloaded.Add(int64(len(message.Data) - 8))
+		peer.OnBlock(idx, begin, message.Data[8:])
 
-		// Verify Hash
-		if sha1.Sum(data) != util.Sha1Sum(peer.Meta.Hashes[idx]) {
-			log.Printf("Bad hash for piece %d\n", idx)
-			return
+	case protocol.MsgChoke, protocol.MsgUnchoke:
+		choked := message.ID == protocol.MsgChoke
+		peer.st.peerChoking.Store(choked)
+		if peer.OnChoke != nil {
+			peer.OnChoke(choked)
 		}
 
-		peer.Pieces[idx] = data
-		peer.Bitfield.Set(idx)
+	case protocol.MsgInterested, protocol.MsgNotInterested:
+		interested := message.ID == protocol.MsgInterested
+		peer.st.peerInterested.Store(interested)
+		if peer.OnInterest != nil {
+			peer.OnInterest(interested)
+		}
 
-		// 1. Notify uploader immediately
-		haveMsg := protocol.Message{
-			ID:   protocol.MsgHave,
-			Data: util.Uint32ToBytes(uint32(idx)),
+	// Remote fetches our info dict (it only knows the infohash)
+	case protocol.MsgMetaRequest:
+		chunk := int(binary.BigEndian.Uint32(message.Data))
+		if peer.Meta == nil {
+			peer.Send(protocol.NewMetaReject(chunk))
+			return nil
 		}
-		// Goes to uploader via same conn
-		peer.SendCh <- haveMsg
+		info := peer.Meta.InfoBytes()
+		start := chunk * protocol.MetaChunk
+		if start >= len(info) {
+			peer.Send(protocol.NewMetaReject(chunk))
+			return nil
+		}
+		end := min(start+protocol.MetaChunk, len(info))
+		peer.Send(protocol.NewMetaData(chunk, len(info), info[start:end]))
 
-		// 2. Then inform piece-picker layer
-		if peer.OnHave != nil {
-			peer.OnHave(idx) // Upper-layer will fan this out to others
+	case protocol.MsgMetaData:
+		if peer.OnMetadata == nil {
+			return nil
 		}
+		chunk := int(binary.BigEndian.Uint32(message.Data[:4]))
+		total := int(binary.BigEndian.Uint32(message.Data[4:8]))
+		peer.OnMetadata(chunk, total, message.Data[8:])
+
+	case protocol.MsgMetaReject:
+		if peer.OnMetadata == nil {
+			return nil
+		}
+		peer.OnMetadata(int(binary.BigEndian.Uint32(message.Data)), 0, nil)
 
 	default:
 		logger.Log("unknown_message_id", map[string]any{
-            "peer": peer.Conn.RemoteAddr().String(),
-            "messageID": message.ID,
-        })
+			"peer":      peer.Conn.RemoteAddr().String(),
+			"messageID": message.ID,
+		})
 	}
+	return nil
 }
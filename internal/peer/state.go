@@ -0,0 +1,55 @@
+// Choke/interest state of one connection and its transfer counters
+
+package peer
+
+import (
+	"sync/atomic"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+// Both sides start choked and not interested (as in BitTorrent).
+// Flags are atomics: the reader goroutine, swarm and choker all touch them.
+type state struct {
+	amChoking      atomic.Bool // we refuse their requests
+	amInterested   atomic.Bool // we want something they have
+	peerChoking    atomic.Bool // they refuse our requests
+	peerInterested atomic.Bool // they want something we have
+
+	uploaded   atomic.Int64 // block bytes sent to them
+	downloaded atomic.Int64 // block bytes received from them
+}
+
+func (peer *Peer) AmChoking() bool      { return peer.st.amChoking.Load() }
+func (peer *Peer) AmInterested() bool   { return peer.st.amInterested.Load() }
+func (peer *Peer) PeerChoking() bool    { return peer.st.peerChoking.Load() }
+func (peer *Peer) PeerInterested() bool { return peer.st.peerInterested.Load() }
+func (peer *Peer) Uploaded() int64      { return peer.st.uploaded.Load() }
+func (peer *Peer) Downloaded() int64    { return peer.st.downloaded.Load() }
+
+// Starts or stops serving their requests; the message is only sent on change
+func (peer *Peer) SetChoking(choke bool) {
+	if peer.st.amChoking.Swap(choke) == choke {
+		return
+	}
+	if choke {
+		peer.up.clear()
+	}
+	id := uint8(protocol.MsgUnchoke)
+	if choke {
+		id = protocol.MsgChoke
+	}
+	peer.Send(protocol.NewState(id))
+}
+
+// Tells them whether we want anything; the message is only sent on change
+func (peer *Peer) SetInterested(interested bool) {
+	if peer.st.amInterested.Swap(interested) == interested {
+		return
+	}
+	id := uint8(protocol.MsgNotInterested)
+	if interested {
+		id = protocol.MsgInterested
+	}
+	peer.Send(protocol.NewState(id))
+}
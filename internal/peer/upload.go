@@ -0,0 +1,102 @@
+// Serving the remote's block requests
+
+package peer
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/ratelimit"
+)
+
+// Requests are queued instead of being served inline by the reader,
+// so a MsgCancel arriving a little later can still take them back
+type uploadQueue struct {
+	mu    sync.Mutex
+	reqs  []blockReq
+	ready chan struct{} // wakes the uploader, 1-buffered
+}
+
+type blockReq struct{ idx, begin, length int }
+
+// More than this many unserved requests is abuse, extra ones are dropped
+const maxQueued = 256
+
+func (q *uploadQueue) push(r blockReq) {
+	q.mu.Lock()
+	if len(q.reqs) < maxQueued {
+		q.reqs = append(q.reqs, r)
+	}
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *uploadQueue) pop() (blockReq, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.reqs) == 0 {
+		return blockReq{}, false
+	}
+	r := q.reqs[0]
+	q.reqs = q.reqs[1:]
+	return r, true
+}
+
+func (q *uploadQueue) cancel(r blockReq) {
+	q.mu.Lock()
+	q.reqs = slices.DeleteFunc(q.reqs, func(x blockReq) bool { return x == r })
+	q.mu.Unlock()
+}
+
+// Choking drops whatever they asked for so far
+func (q *uploadQueue) clear() {
+	q.mu.Lock()
+	q.reqs = nil
+	q.mu.Unlock()
+}
+
+// Serves queued requests until the connection dies
+func (peer *Peer) uploader() {
+	for {
+		select {
+		case <-peer.up.ready:
+		case <-peer.done:
+			return
+		}
+		for {
+			r, ok := peer.up.pop()
+			if !ok {
+				break
+			}
+			peer.serve(r)
+		}
+	}
+}
+
+func (peer *Peer) serve(r blockReq) {
+	if peer.AmChoking() {
+		return // choked after asking
+	}
+	if peer.cachedIdx != r.idx {
+		piece, err := peer.Store.ReadPiece(r.idx)
+		if err != nil {
+			logger.Log("read_piece_err", map[string]any{"piece": r.idx, "err": err.Error()})
+			return
+		}
+		peer.cachedIdx, peer.cachedPiece = r.idx, piece
+	}
+	if r.begin+r.length > len(peer.cachedPiece) {
+		return
+	}
+	// Only pieces wait here; control messages go straight to SendCh
+	if !ratelimit.Wait(r.length, peer.done, peer.UpLimits...) || peer.AmChoking() {
+		return
+	}
+	peer.Send(protocol.NewPiece(r.idx, r.begin, peer.cachedPiece[r.begin:r.begin+r.length]))
+	peer.st.uploaded.Add(int64(r.length))
+}
@@ -0,0 +1,168 @@
+// Checks on everything the remote sends, and why connections end
+
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/logger"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+// Why a connection ended, as logged in peer_disconnect and returned by Reason
+const (
+	ReasonEOF              = "eof"               // remote hung up
+	ReasonClosed           = "closed"            // we hung up (ban, pause, shutdown...)
+	ReasonReadError        = "read_error"        // network trouble
+	ReasonWriteError       = "write_error"       // network trouble, or the remote stopped reading
+	ReasonHandshakeTimeout = "handshake_timeout" // no handshake in time
+	ReasonIdleTimeout      = "idle_timeout"      // nothing at all, not even keep-alives
+	ReasonTooLarge         = "message_too_large"
+	ReasonBadHandshake     = "bad_handshake"
+	ReasonWrongTorrent     = "infohash_mismatch"
+	ReasonRefused          = "refused" // Admit said no
+	ReasonBadMessage       = "bad_message"
+)
+
+// Protocol violation: the remote sent something no honest peer would
+type violation struct {
+	reason string
+	detail string
+}
+
+func (v *violation) Error() string { return v.reason + ": " + v.detail }
+
+func bad(format string, args ...any) error {
+	return &violation{reason: ReasonBadMessage, detail: fmt.Sprintf(format, args...)}
+}
+
+// Lengths and indices of *msg*, checked against Meta before anything uses them.
+// Bounds are those of a torrent we know; without Meta (magnet fetch) only
+// metadata messages make sense and the rest is ignored by handle.
+func (peer *Peer) validate(msg *protocol.Message) error {
+	n := len(msg.Data)
+	pieces := -1 // unknown
+	if peer.Meta != nil {
+		pieces = len(peer.Meta.Hashes)
+	}
+	u32 := func(off int) int { return int(binary.BigEndian.Uint32(msg.Data[off:])) }
+	piece := func(idx int) error {
+		if pieces >= 0 && (idx < 0 || idx >= pieces) {
+			return bad("piece %d of %d", idx, pieces)
+		}
+		return nil
+	}
+	// Block [begin, begin+length) inside piece idx and not bigger than MaxBlock
+	block := func(idx, begin, length int) error {
+		if err := piece(idx); err != nil {
+			return err
+		}
+		if length <= 0 || length > protocol.MaxBlock {
+			return bad("block length %d", length)
+		}
+		if pieces >= 0 && (begin < 0 || begin+length > peer.Meta.PieceLen(idx)) {
+			return bad("block %d+%d outside piece %d", begin, length, idx)
+		}
+		return nil
+	}
+
+	switch msg.ID {
+	case protocol.MsgKeepAlive:
+		return nil
+	case protocol.MsgHandshake:
+		if peer.handshakeDone {
+			return bad("second handshake")
+		}
+		if n != 40 {
+			return &violation{ReasonBadHandshake, fmt.Sprintf("length %d", n)}
+		}
+	case protocol.MsgBitfield:
+		if pieces >= 0 && n != pieces {
+			return bad("bitfield of %d, want %d", n, pieces)
+		}
+		for i, b := range msg.Data {
+			if b > 1 {
+				return bad("bitfield byte %d is %d", i, b)
+			}
+		}
+	case protocol.MsgHave:
+		if n != 4 {
+			return bad("have length %d", n)
+		}
+		return piece(u32(0))
+	case protocol.MsgRequest, protocol.MsgCancel:
+		if n != 12 {
+			return bad("request length %d", n)
+		}
+		return block(u32(0), u32(4), u32(8))
+	case protocol.MsgPiece:
+		if n < 8 {
+			return bad("piece length %d", n)
+		}
+		return block(u32(0), u32(4), n-8)
+	case protocol.MsgChoke, protocol.MsgUnchoke, protocol.MsgInterested, protocol.MsgNotInterested:
+		if n != 0 {
+			return bad("state message %d with %d bytes", msg.ID, n)
+		}
+	case protocol.MsgMetaRequest, protocol.MsgMetaReject:
+		if n != 4 {
+			return bad("metadata message %d length %d", msg.ID, n)
+		}
+	case protocol.MsgMetaData:
+		if n < 8 || n-8 > protocol.MetaChunk {
+			return bad("metadata chunk length %d", n)
+		}
+	}
+	return nil // unknown IDs are logged and skipped by handle
+}
+
+// Hangs up with *reason*; the first reason given sticks
+func (peer *Peer) drop(reason, detail string) {
+	peer.reasonOnce.Do(func() {
+		peer.reason = reason
+		fields := map[string]any{"peer": peer.Conn.RemoteAddr().String(), "reason": reason}
+		if detail != "" {
+			fields["detail"] = detail
+		}
+		logger.Log("peer_disconnect", fields)
+	})
+	peer.Conn.Close()
+}
+
+// Why the connection ended, "" while it is alive
+func (peer *Peer) Reason() string {
+	select {
+	case <-peer.done:
+		return peer.reason
+	default:
+		return ""
+	}
+}
+
+// Turns the error that stopped the reader into a reason
+func (peer *Peer) readFailed(err error) {
+	var v *violation
+	switch {
+	case errors.As(err, &v):
+		peer.drop(v.reason, v.detail)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		peer.drop(ReasonEOF, "")
+	case errors.Is(err, net.ErrClosed):
+		peer.drop(ReasonClosed, "")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		if peer.handshakeDone {
+			peer.drop(ReasonIdleTimeout, "")
+		} else {
+			peer.drop(ReasonHandshakeTimeout, "")
+		}
+	case errors.Is(err, protocol.ErrTooLarge):
+		peer.drop(ReasonTooLarge, err.Error())
+	default:
+		peer.drop(ReasonReadError, err.Error())
+	}
+}
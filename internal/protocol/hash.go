@@ -1,17 +1,19 @@
 package protocol
 
 import (
-	"crypto/sha1"
-	"os"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
 )
 
-// Reads torrent file from dist and returns
+// Reads torrent file from disk and returns
 // SHA-1 20-byte ID that all peers must
 // present in their Handshake.
+//
+// The ID is computed over the content (see metainfo.Meta.InfoHash),
+// not the file bytes, so re-indenting or re-saving a .bit keeps the swarm.
 func InfoHash(path string) ([20]byte, error) {
-	data, err := os.ReadFile(path)
+	m, err := metainfo.Load(path)
 	if err != nil {
 		return [20]byte{}, err
 	}
-	return sha1.Sum(data), nil
+	return m.InfoHash(), nil
 }
@@ -1,10 +1,11 @@
 package protocol
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"crypto/rand"
 
 	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
 	"github.com/BitTorrentFileSharing/bittorrent/internal/util"
@@ -16,11 +17,32 @@ const (
 	MsgRequest
 	MsgPiece
 	MsgHave
+	MsgMetaRequest // 4-byte chunk index
+	MsgMetaData    // 4-byte chunk index, 4-byte total size, chunk bytes
+	MsgMetaReject  // 4-byte chunk index, "I don't have metadata"
+	MsgChoke       // no payload: "I won't serve your requests"
+	MsgUnchoke     // no payload: "ask away"
+	MsgInterested  // no payload: "you have pieces I want"
+	MsgNotInterested
+	MsgCancel // same payload as MsgRequest: "never mind that block"
 )
 
+// A zero-length frame on the wire ("still here"); never a real message ID
+const MsgKeepAlive = 0xFF
+
+// Frames longer than this are refused before anything is allocated. Fits a
+// MaxBlock piece, a metadata chunk and the bitfield of 1M pieces (one byte each).
+const MaxMessage = 1 << 20
+
+var ErrTooLarge = errors.New("message too large")
+
+// Metadata (bencoded info dict) is exchanged in chunks of this size.
+// Everything but the last chunk is exactly MetaChunk bytes.
+const MetaChunk = 16 * 1024
+
 // Handshake payload:
 //
-//	20‑byte infoHash  – SHA‑1(torrent metadata)
+//	20‑byte infoHash  – SHA‑1(canonical info dict, see metainfo.Meta.InfoHash)
 //	20‑byte peerID    – random ASCII string
 //
 // length = 1 (ID) + 20 + 20 = 41
@@ -39,38 +61,82 @@ func NewBitfield(bf storage.Bitfield) Message {
 	return Message{ID: MsgBitfield, Data: bf.Bytes()}
 }
 
-func NewRequest(idx int) Message {
+// Pieces are transferred in blocks of this size (the last block of
+// a piece may be shorter). Peers refuse requests larger than MaxBlock.
+const (
+	BlockSize = 16 * 1024
+	MaxBlock  = 128 * 1024
+)
+
+// Request payload: 4-byte piece index, 4-byte begin, 4-byte length
+func NewRequest(idx, begin, length int) Message {
+	return Message{ID: MsgRequest, Data: blockRef(idx, begin, length)}
+}
+
+// Withdraws an earlier request (endgame: the block came from someone else)
+func NewCancel(idx, begin, length int) Message {
+	return Message{ID: MsgCancel, Data: blockRef(idx, begin, length)}
+}
+
+func blockRef(idx, begin, length int) []byte {
+	data := make([]byte, 0, 12)
+	data = append(data, util.Uint32ToBytes(uint32(idx))...)
+	data = append(data, util.Uint32ToBytes(uint32(begin))...)
+	data = append(data, util.Uint32ToBytes(uint32(length))...)
+	return data
+}
+
+// Piece payload: 4-byte piece index, 4-byte begin, block bytes
+func NewPiece(idx, begin int, block []byte) Message {
+	data := make([]byte, 0, 8+len(block))
+	data = append(data, util.Uint32ToBytes(uint32(idx))...)
+	data = append(data, util.Uint32ToBytes(uint32(begin))...)
+	data = append(data, block...)
+	return Message{ID: MsgPiece, Data: data}
+}
+
+func NewHave(idx int) Message {
 	return Message{
-		ID: MsgRequest,
-		Data: append(
-			util.Uint32ToBytes(uint32(idx)),
-			util.Uint32ToBytes(0)..., // Offset is 0
-		),
+		ID:   MsgHave,
+		Data: util.Uint32ToBytes(uint32(idx)),
 	}
 }
 
-func NewPiece(idx int, piece []byte) Message {
+func NewKeepAlive() Message {
+	return Message{ID: MsgKeepAlive}
+}
+
+// Choke/unchoke/interested/not-interested carry no payload
+func NewState(id uint8) Message {
+	return Message{ID: id}
+}
+
+func NewMetaRequest(chunk int) Message {
+	return Message{ID: MsgMetaRequest, Data: util.Uint32ToBytes(uint32(chunk))}
+}
+
+func NewMetaData(chunk, total int, data []byte) Message {
 	return Message{
-		ID: MsgPiece,
+		ID: MsgMetaData,
 		Data: append(
 			append(
-				util.Uint32ToBytes(uint32(idx)),
-				util.Uint32ToBytes(0)..., // Offset is 0
+				util.Uint32ToBytes(uint32(chunk)),
+				util.Uint32ToBytes(uint32(total))...,
 			),
-			piece...,
+			data...,
 		),
 	}
 }
 
-func NewHave(idx int) Message {
-	return Message{
-		ID: MsgHave,
-		Data: util.Uint32ToBytes(uint32(idx)),
-	}
+func NewMetaReject(chunk int) Message {
+	return Message{ID: MsgMetaReject, Data: util.Uint32ToBytes(uint32(chunk))}
 }
 
 // Forms TCP-packet
 func (m *Message) Encode(pipe io.Writer) error {
+	if m.ID == MsgKeepAlive {
+		return binary.Write(pipe, binary.BigEndian, uint32(0))
+	}
 	// 1. Write prefix which tells length of message.
 	// 1-byte for ID. N-byte for Data
 	if err := binary.Write(pipe, binary.BigEndian, uint32(1+len(m.Data))); err != nil {
@@ -85,7 +151,8 @@ func (m *Message) Encode(pipe io.Writer) error {
 	return err
 }
 
-// Decodes message with ID and DATA from reader
+// Decodes message with ID and DATA from reader.
+// A keep-alive comes back as MsgKeepAlive without data.
 func Decode(r io.Reader) (*Message, error) {
 	// 1. Read data length (represented in 4 bytes)
 	var size uint32
@@ -93,7 +160,10 @@ func Decode(r io.Reader) (*Message, error) {
 		return nil, err
 	}
 	if size == 0 {
-		return nil, errors.New("invalid message size")
+		return &Message{ID: MsgKeepAlive}, nil
+	}
+	if size > MaxMessage {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
 	}
 	// 2. Read the rest of data sized [size]
 	buf := make([]byte, size)
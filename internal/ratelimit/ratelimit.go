@@ -0,0 +1,95 @@
+// Token buckets for piece traffic; the rate can change while in use
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter lets *rate* bytes per second through, with bursts up to one
+// second's worth. Rate 0 means unlimited. A nil Limiter is unlimited too.
+//
+// A caller takes its bytes at once and may leave the bucket in debt, so a
+// 16 KiB block still passes a 1 KiB/s limit; the next caller waits it off.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func New(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// Changes the rate; waits already handed out are not shortened
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.rate <= 0 {
+		l.tokens = float64(max(rate, 0)) // from unlimited: start with a full bucket
+	} else {
+		l.refill(now)
+	}
+	l.rate = max(rate, 0)
+	l.tokens = min(l.tokens, float64(l.rate))
+	l.last = now
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.tokens = min(l.tokens, float64(l.rate))
+	l.last = now
+}
+
+// Takes *n* bytes and says how long the caller must wait before using them
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Blocks until *n* bytes may pass every limiter in *ls* (nil entries are
+// skipped). Returns false if *cancel* closed first.
+func Wait(n int, cancel <-chan struct{}, ls ...*Limiter) bool {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range ls {
+		wait = max(wait, l.reserve(n, now))
+	}
+	if wait == 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
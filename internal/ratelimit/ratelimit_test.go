@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	l := New(1000)
+	now := l.last
+
+	if d := l.reserve(1000, now); d != 0 {
+		t.Fatalf("full bucket should not wait, got %v", d)
+	}
+	// Empty now: 500 more bytes are half a second of debt
+	if d := l.reserve(500, now); d != 500*time.Millisecond {
+		t.Fatalf("want 500ms, got %v", d)
+	}
+	// One second later the debt is paid and 500 tokens are back
+	if d := l.reserve(500, now.Add(time.Second)); d != 0 {
+		t.Fatalf("want no wait, got %v", d)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	if d := nilLimiter.reserve(1<<30, time.Now()); d != 0 {
+		t.Fatalf("nil limiter waited %v", d)
+	}
+	l := New(0)
+	if d := l.reserve(1<<30, time.Now()); d != 0 {
+		t.Fatalf("rate 0 waited %v", d)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := New(0)
+	l.SetRate(100)
+	now := l.last
+	if d := l.reserve(200, now); d != time.Second {
+		t.Fatalf("want 1s, got %v", d)
+	}
+	l.SetRate(0)
+	if d := l.reserve(1<<20, now); d != 0 {
+		t.Fatalf("lifted limit still waits %v", d)
+	}
+}
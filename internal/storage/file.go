@@ -0,0 +1,190 @@
+// Disk-backed pieces: piece i lives at payload offset i*pieceSize,
+// which may fall into one or several of the payload files
+
+package storage
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage reads and writes pieces directly at their file offsets,
+// so a torrent never has to fit into RAM.
+type FileStorage struct {
+	pieceSet
+	mu     sync.Mutex
+	files  []*os.File // one per layout entry
+	layout Layout
+}
+
+// Opens an existing, complete payload for seeding (read-only).
+func OpenFile(root string, l Layout) (*FileStorage, error) {
+	paths, err := l.paths(root)
+	if err != nil {
+		return nil, err
+	}
+	entries := l.entries()
+	fs := &FileStorage{pieceSet: newPieceSet(l.NumPieces(), true), layout: l}
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.files = append(fs.files, f)
+		info, err := f.Stat()
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		if info.Size() != entries[i].Length {
+			fs.Close()
+			return nil, fmt.Errorf("%s: size %d, metainfo says %d", path, info.Size(), entries[i].Length)
+		}
+	}
+	return fs, nil
+}
+
+// Creates (or reuses) the output files of a download and sizes them.
+func CreateFile(root string, l Layout) (*FileStorage, error) {
+	paths, err := l.paths(root)
+	if err != nil {
+		return nil, err
+	}
+	entries := l.entries()
+	fs := &FileStorage{pieceSet: newPieceSet(l.NumPieces(), false), layout: l}
+	for i, path := range paths {
+		f, err := createSized(path, entries[i].Length)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.files = append(fs.files, f)
+	}
+	return fs, nil
+}
+
+// Opens *path* read-write, creating parent dirs, and truncates it to *length*
+func createSized(path string, length int64) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// Leave a file of the right size untouched: truncate bumps mtime,
+	// which would invalidate the resume state
+	info, err := f.Stat()
+	if err == nil && info.Size() != length {
+		err = f.Truncate(length)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reads piece *idx* from disk
+func (fs *FileStorage) ReadPiece(idx int) ([]byte, error) {
+	off, size, err := fs.layout.Bounds(idx)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	pos := 0
+	for _, s := range fs.layout.spans(off, size) {
+		if _, err := fs.files[s.file].ReadAt(buf[pos:pos+s.n], s.off); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		pos += s.n
+	}
+	return buf, nil
+}
+
+// Writes piece *idx* at its offset(s)
+func (fs *FileStorage) WritePiece(idx int, data []byte) error {
+	off, err := fs.layout.check(idx, data)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	pos := 0
+	for _, s := range fs.layout.spans(off, len(data)) {
+		if _, err = fs.files[s.file].WriteAt(data[pos:pos+s.n], s.off); err != nil {
+			break
+		}
+		pos += s.n
+	}
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.MarkPiece(idx)
+	return nil
+}
+
+// Flushes and closes the underlying files
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var firstErr error
+	for _, f := range fs.files {
+		_ = f.Sync()
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// HashPayload streams the payload under *root* once and returns SHA-1
+// of every piece. Unlike Split it keeps only one piece in memory at a time,
+// and pieces crossing file boundaries are hashed over the concatenation.
+func HashPayload(root string, l Layout) ([][]byte, error) {
+	paths, err := l.paths(root)
+	if err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	buf := make([]byte, l.PieceSize)
+	fill := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, readErr := io.ReadFull(f, buf[fill:])
+			fill += n
+			if fill == len(buf) {
+				h := sha1.Sum(buf)
+				hashes = append(hashes, h[:])
+				fill = 0
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			} else if readErr != nil {
+				f.Close()
+				return nil, readErr
+			}
+		}
+		f.Close()
+	}
+	if fill > 0 { // final partial piece
+		h := sha1.Sum(buf[:fill])
+		hashes = append(hashes, h[:])
+	}
+	if len(hashes) != l.NumPieces() {
+		return nil, fmt.Errorf("%s changed while hashing", root)
+	}
+	return hashes, nil
+}
@@ -22,3 +22,19 @@ func Join(pieces [][]byte, path string) error {
 	}
 	return nil
 }
+
+// JoinFiles is Join for any layout: pieces are written back
+// into every file of the payload under *root*.
+func JoinFiles(pieces [][]byte, root string, l Layout) error {
+	fs, err := CreateFile(root, l)
+	if err != nil {
+		return err
+	}
+	for idx, piece := range pieces {
+		if err := fs.WritePiece(idx, piece); err != nil {
+			fs.Close()
+			return err
+		}
+	}
+	return fs.Close()
+}
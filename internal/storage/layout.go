@@ -0,0 +1,150 @@
+// Piece geometry: how pieces map onto one or many payload files
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// One file of a multi-file payload
+type FileEntry struct {
+	Path   string // slash-separated, relative to the payload root
+	Length int64
+}
+
+// Layout describes how a payload is cut into pieces.
+// Files == nil means a single-file payload of Length bytes.
+// Otherwise the files are concatenated in order and pieces may span them.
+type Layout struct {
+	PieceSize int
+	Length    int64
+	Files     []FileEntry
+}
+
+// Number of pieces covering the payload
+func (l Layout) NumPieces() int {
+	return int((l.Length + int64(l.PieceSize) - 1) / int64(l.PieceSize))
+}
+
+// Returns offset and size of piece *idx*. The last piece may be shorter.
+func (l Layout) Bounds(idx int) (int64, int, error) {
+	if idx < 0 || idx >= l.NumPieces() {
+		return 0, 0, fmt.Errorf("piece %d out of range", idx)
+	}
+	off := int64(idx) * int64(l.PieceSize)
+	size := int64(l.PieceSize)
+	if off+size > l.Length {
+		size = l.Length - off
+	}
+	return off, int(size), nil
+}
+
+// Checks that *data* has exactly the size of piece *idx*
+func (l Layout) check(idx int, data []byte) (int64, error) {
+	off, size, err := l.Bounds(idx)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != size {
+		return 0, fmt.Errorf("piece %d: got %d bytes, want %d", idx, len(data), size)
+	}
+	return off, nil
+}
+
+// Files of the payload; a single-file layout is one unnamed entry
+func (l Layout) entries() []FileEntry {
+	if l.Files == nil {
+		return []FileEntry{{Length: l.Length}}
+	}
+	return l.Files
+}
+
+// On-disk paths of every payload file under *root*.
+// Entries that would escape root (absolute, "..") are rejected,
+// since layouts may come from untrusted metainfo.
+func (l Layout) paths(root string) ([]string, error) {
+	if l.Files == nil {
+		return []string{root}, nil
+	}
+	out := make([]string, len(l.Files))
+	for i, f := range l.Files {
+		rel := filepath.FromSlash(f.Path)
+		if f.Path == "" || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("bad file path %q in layout", f.Path)
+		}
+		out[i] = filepath.Join(root, rel)
+	}
+	return out, nil
+}
+
+// A contiguous run of payload bytes inside one file
+type span struct {
+	file int   // index into entries()
+	off  int64 // offset inside that file
+	n    int
+}
+
+// Maps payload range [off, off+n) onto per-file spans
+func (l Layout) spans(off int64, n int) []span {
+	var out []span
+	var start int64 // payload offset of the current file
+	for i, f := range l.entries() {
+		end := start + f.Length
+		if n > 0 && off < end && f.Length > 0 {
+			take := min(int64(n), end-off)
+			out = append(out, span{file: i, off: off - start, n: int(take)})
+			off += take
+			n -= int(take)
+		}
+		start = end
+	}
+	return out
+}
+
+// Builds the layout of a payload on disk: a single file, or every
+// regular file below a directory in lexical order.
+func ScanPayload(path string, pieceSize int) (Layout, error) {
+	if pieceSize <= 0 {
+		pieceSize = DefaultPiece
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Layout{}, err
+	}
+	if !info.IsDir() {
+		return Layout{PieceSize: pieceSize, Length: info.Size()}, nil
+	}
+
+	l := Layout{PieceSize: pieceSize, Files: []FileEntry{}}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil // dirs, symlinks, sockets...
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		l.Files = append(l.Files, FileEntry{Path: filepath.ToSlash(rel), Length: fi.Size()})
+		l.Length += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return Layout{}, err
+	}
+	if len(l.Files) == 0 {
+		return Layout{}, errors.New(strings.TrimSuffix(path, "/") + ": no files to share")
+	}
+	return l, nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "errors"
+
+// Placeholder so the mmap backend can be selected everywhere the build works
+type MmapStorage struct{ FileStorage }
+
+func OpenMmap(_ string, _ Layout, _ bool) (*MmapStorage, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
@@ -0,0 +1,146 @@
+//go:build linux || darwin || freebsd
+
+// mmap-backed pieces: every payload file is mapped once and pieces are plain copies
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// MmapStorage maps the whole payload into the address space
+type MmapStorage struct {
+	pieceSet
+	mu       sync.RWMutex
+	files    []*os.File
+	data     [][]byte // one mapping per layout entry (nil for empty files)
+	closed   bool
+	writable bool
+	layout   Layout
+}
+
+// Maps the payload under *root*. With create == true the files are created/sized
+// and mapped writable, otherwise an existing complete payload is mapped read-only.
+func OpenMmap(root string, l Layout, create bool) (*MmapStorage, error) {
+	paths, err := l.paths(root)
+	if err != nil {
+		return nil, err
+	}
+	prot := syscall.PROT_READ
+	if create {
+		prot |= syscall.PROT_WRITE
+	}
+	ms := &MmapStorage{pieceSet: newPieceSet(l.NumPieces(), !create), writable: create, layout: l}
+	for i, entry := range l.entries() {
+		data, f, err := mapFile(paths[i], entry.Length, prot, create)
+		if f != nil {
+			ms.files = append(ms.files, f)
+		}
+		if err != nil {
+			ms.Close()
+			return nil, err
+		}
+		ms.data = append(ms.data, data)
+	}
+	return ms, nil
+}
+
+// Opens (or creates) one file and maps *length* bytes of it
+func mapFile(path string, length int64, prot int, create bool) ([]byte, *os.File, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if create {
+		f, err = createSized(path, length)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, f, err
+	}
+	if info.Size() != length {
+		return nil, f, fmt.Errorf("%s: size %d, metainfo says %d", path, info.Size(), length)
+	}
+	if length == 0 { // mmap refuses empty mappings
+		return nil, f, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(length), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, f, fmt.Errorf("mmap %s: %w", path, err)
+	}
+	return data, f, nil
+}
+
+func (ms *MmapStorage) ReadPiece(idx int) ([]byte, error) {
+	off, size, err := ms.layout.Bounds(idx)
+	if err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return nil, os.ErrClosed
+	}
+	// Copy out: the mapping dies on Close while peers may still hold the slice
+	buf := make([]byte, size)
+	pos := 0
+	for _, s := range ms.layout.spans(off, size) {
+		pos += copy(buf[pos:pos+s.n], ms.data[s.file][s.off:])
+	}
+	return buf, nil
+}
+
+func (ms *MmapStorage) WritePiece(idx int, data []byte) error {
+	off, err := ms.layout.check(idx, data)
+	if err != nil {
+		return err
+	}
+	if !ms.writable { // writing into a PROT_READ mapping would crash the process
+		return fmt.Errorf("piece %d: mapping is read-only", idx)
+	}
+	ms.mu.Lock()
+	if ms.closed {
+		ms.mu.Unlock()
+		return os.ErrClosed
+	}
+	pos := 0
+	for _, s := range ms.layout.spans(off, len(data)) {
+		pos += copy(ms.data[s.file][s.off:s.off+int64(s.n)], data[pos:])
+	}
+	ms.mu.Unlock()
+	ms.MarkPiece(idx)
+	return nil
+}
+
+// Unmaps (dirty pages are written back by the kernel) and closes the files
+func (ms *MmapStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return nil
+	}
+	ms.closed = true
+	var firstErr error
+	for _, data := range ms.data {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, f := range ms.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,100 @@
+// Resuming downloads: re-check partial data on disk and remember what was verified
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"os"
+	"slices"
+	"time"
+)
+
+// Verify reads every piece of *st*, compares it with *hashes* and
+// marks the good ones as present. Returns which pieces passed.
+func Verify(st Storage, hashes [][]byte) Bitfield {
+	bf := NewBitfield(len(hashes))
+	for idx, want := range hashes {
+		data, err := st.ReadPiece(idx)
+		if err != nil { // e.g. memory backend has nothing yet
+			continue
+		}
+		if sum := sha1.Sum(data); bytes.Equal(sum[:], want) {
+			st.MarkPiece(idx)
+			bf.Set(idx)
+		}
+	}
+	return bf
+}
+
+// ResumeState sits next to a download and records which pieces were
+// verified, plus size/mtime of every payload file at that moment.
+// If the files still look the same on restart, the full re-hash is skipped.
+type ResumeState struct {
+	InfoHash string      `json:"info_hash"` // hex, guards against reusing another torrent's state
+	Have     Bitfield    `json:"have"`
+	Files    []FileStamp `json:"files"`
+}
+
+type FileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Stamps every payload file under *root*
+func StampPayload(root string, l Layout) ([]FileStamp, error) {
+	paths, err := l.paths(root)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make([]FileStamp, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, FileStamp{Size: info.Size(), ModTime: info.ModTime().UTC()})
+	}
+	return stamps, nil
+}
+
+// Reads a resume file. A missing file is not an error (nil state).
+func LoadResume(path string) (*ResumeState, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rs ResumeState
+	return &rs, json.Unmarshal(b, &rs)
+}
+
+// Saves state atomically (write tmp + rename)
+func (rs *ResumeState) Save(path string) error {
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Whether the state still describes the payload under *root*
+func (rs *ResumeState) Matches(infoHash string, root string, l Layout) bool {
+	if rs == nil || rs.InfoHash != infoHash || len(rs.Have) != l.NumPieces() {
+		return false
+	}
+	stamps, err := StampPayload(root, l)
+	if err != nil {
+		return false
+	}
+	return slices.EqualFunc(stamps, rs.Files, func(a, b FileStamp) bool {
+		return a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+	})
+}
@@ -50,3 +50,24 @@ func Split(path string, pieceSize int) (pieces [][]byte, hashes [][]byte, err er
 	}
 	return pieces, hashes, nil
 }
+
+// SplitFiles is Split for any layout: it reads the payload under *root*
+// (one file or a whole tree) and cuts it into pieces that may span files.
+func SplitFiles(root string, l Layout) (pieces [][]byte, hashes [][]byte, err error) {
+	fs, err := OpenFile(root, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fs.Close()
+
+	for idx := range l.NumPieces() {
+		p, err := fs.ReadPiece(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha1.Sum(p)
+		pieces = append(pieces, p)
+		hashes = append(hashes, h[:])
+	}
+	return pieces, hashes, nil
+}
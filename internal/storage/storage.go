@@ -0,0 +1,84 @@
+// Piece storage backends shared by Session, Swarm and peers
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Storage is where pieces of one torrent live.
+// Implementations must be safe for concurrent use by many peers.
+type Storage interface {
+	ReadPiece(idx int) ([]byte, error)
+	WritePiece(idx int, data []byte) error
+	HasPiece(idx int) bool
+	// Marks a piece already on disk as present (verified on resume)
+	MarkPiece(idx int)
+	Close() error
+}
+
+// Backend names accepted by Open (and the -storage flag)
+const (
+	KindFile   = "file"
+	KindMmap   = "mmap"
+	KindMemory = "memory"
+)
+
+// Opens a backend by name. *path* is the payload file, or the root
+// directory when the layout has several files.
+//
+// With create == false the payload at *path* must already be complete
+// (seeding); otherwise it is created/sized for a download and starts empty.
+func Open(kind, path string, l Layout, create bool) (Storage, error) {
+	switch kind {
+	case KindFile, "":
+		if create {
+			return CreateFile(path, l)
+		}
+		return OpenFile(path, l)
+	case KindMmap:
+		return OpenMmap(path, l, create)
+	case KindMemory:
+		if create {
+			ms := NewMemory(l)
+			ms.out = path
+			return ms, nil
+		}
+		return LoadMemory(path, l)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// Thread-safe record of which pieces a backend holds
+type pieceSet struct {
+	mu   sync.RWMutex
+	have Bitfield
+}
+
+func newPieceSet(n int, full bool) pieceSet {
+	bf := NewBitfield(n)
+	if full {
+		for i := range bf {
+			bf.Set(i)
+		}
+	}
+	return pieceSet{have: bf}
+}
+
+// Reports whether piece *idx* is stored
+func (ps *pieceSet) HasPiece(idx int) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return idx >= 0 && idx < len(ps.have) && ps.have.Has(idx)
+}
+
+func (ps *pieceSet) MarkPiece(idx int) {
+	if idx < 0 || idx >= len(ps.have) {
+		return
+	}
+	ps.mu.Lock()
+	ps.have.Set(idx)
+	ps.mu.Unlock()
+}
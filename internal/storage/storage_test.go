@@ -0,0 +1,167 @@
+package storage_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/storage"
+)
+
+func TestBackendsRoundTrip(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src.bin")
+	payload := bytes.Repeat([]byte("0123456789"), 100) // 1000 bytes, last piece short
+	os.WriteFile(src, payload, 0o644)
+
+	layout, err := storage.ScanPayload(src, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := storage.HashPayload(src, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, splitHashes, _ := storage.Split(src, 256)
+	if layout.Length != 1000 || len(hashes) != len(splitHashes) {
+		t.Fatalf("got %d hashes / %d bytes", len(hashes), layout.Length)
+	}
+
+	for _, kind := range []string{storage.KindFile, storage.KindMmap, storage.KindMemory} {
+		seed, err := storage.Open(kind, src, layout, false)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		out := filepath.Join(tmp, kind, "dst.bin")
+		dst, err := storage.Open(kind, out, layout, true)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		// Copy pieces in reverse order, like a swarm would deliver them
+		for i := layout.NumPieces() - 1; i >= 0; i-- {
+			if !seed.HasPiece(i) || dst.HasPiece(i) {
+				t.Fatalf("%s: wrong HasPiece(%d)", kind, i)
+			}
+			piece, err := seed.ReadPiece(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.WritePiece(i, piece); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dst.WritePiece(0, []byte("short")); err == nil {
+			t.Fatalf("%s: accepted piece with wrong size", kind)
+		}
+
+		var got []byte
+		for i := range layout.NumPieces() {
+			piece, _ := dst.ReadPiece(i)
+			got = append(got, piece...)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: payload mismatch", kind)
+		}
+		seed.Close()
+		dst.Close()
+	}
+}
+
+func TestMultiFilePiecesSpanFiles(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "tree")
+	files := map[string]int{"a.txt": 300, "empty": 0, "sub/b.bin": 5, "sub/deeper/c.bin": 700}
+	var payload []byte // concatenation in lexical path order
+	for _, name := range []string{"a.txt", "empty", "sub/b.bin", "sub/deeper/c.bin"} {
+		data := bytes.Repeat([]byte{byte(len(name))}, files[name])
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755)
+		os.WriteFile(filepath.Join(root, name), data, 0o644)
+		payload = append(payload, data...)
+	}
+
+	layout, err := storage.ScanPayload(root, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Files) != 4 || layout.Length != 1005 || layout.Files[3].Path != "sub/deeper/c.bin" {
+		t.Fatalf("bad layout %+v", layout)
+	}
+
+	pieces, hashes, err := storage.SplitFiles(root, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, _ := storage.HashPayload(root, layout)
+	for i := range hashes {
+		if !bytes.Equal(hashes[i], streamed[i]) {
+			t.Fatalf("piece %d: split and streamed hashes differ", i)
+		}
+	}
+	if !bytes.Equal(bytes.Join(pieces, nil), payload) {
+		t.Fatalf("pieces do not cover the payload")
+	}
+
+	out := filepath.Join(tmp, "copy")
+	if err := storage.JoinFiles(pieces, out, layout); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range files {
+		info, err := os.Stat(filepath.Join(out, name))
+		if err != nil || info.Size() != int64(size) {
+			t.Fatalf("%s not restored", name)
+		}
+	}
+
+	bad := storage.Layout{PieceSize: 256, Length: 1, Files: []storage.FileEntry{{Path: "../evil", Length: 1}}}
+	if _, err := storage.Open(storage.KindFile, out, bad, true); err == nil {
+		t.Fatalf("path escaping the root was accepted")
+	}
+}
+
+func TestVerifyAndResumeState(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src.bin")
+	os.WriteFile(src, bytes.Repeat([]byte("xyz"), 300), 0o644)
+	layout, _ := storage.ScanPayload(src, 256)
+	hashes, _ := storage.HashPayload(src, layout)
+
+	// Partial download: only pieces 1 and 3 made it to disk
+	seed, _ := storage.OpenFile(src, layout)
+	defer seed.Close()
+	out := filepath.Join(tmp, "dl.bin")
+	dst, _ := storage.CreateFile(out, layout)
+	for _, idx := range []int{1, 3} {
+		p, _ := seed.ReadPiece(idx)
+		dst.WritePiece(idx, p)
+	}
+	dst.Close()
+
+	again, _ := storage.CreateFile(out, layout)
+	have := storage.Verify(again, hashes)
+	again.Close()
+	if have.Has(0) || !have.Has(1) || have.Has(2) || !have.Has(3) {
+		t.Fatalf("wrong verified set %v", have)
+	}
+
+	stamps, err := storage.StampPayload(out, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &storage.ResumeState{InfoHash: "ab", Have: have, Files: stamps}
+	statePath := out + ".resume"
+	if err := state.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := storage.LoadResume(statePath)
+	if !loaded.Matches("ab", out, layout) || loaded.Matches("cd", out, layout) {
+		t.Fatalf("resume state match is wrong")
+	}
+
+	// Touching the payload invalidates the state
+	os.WriteFile(out, bytes.Repeat([]byte{0}, int(layout.Length)), 0o644)
+	if loaded.Matches("ab", out, layout) {
+		t.Fatalf("stale resume state accepted")
+	}
+}
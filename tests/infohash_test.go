@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+func TestInfoHashIgnoresFormatting(t *testing.T) {
+	tmp := t.TempDir()
+	h := sha1.Sum([]byte("piece"))
+	m := &metainfo.Meta{FileName: "f.bin", FileLength: 10, PieceSize: 256, Hashes: [][]byte{h[:]}}
+
+	indented := filepath.Join(tmp, "a.bit")
+	m.Write(indented)
+	compact := filepath.Join(tmp, "b.bit")
+	b, _ := json.Marshal(m)
+	os.WriteFile(compact, b, 0o644)
+	torrent := filepath.Join(tmp, "c.torrent")
+	m.WriteTorrent(torrent)
+
+	a, _ := protocol.InfoHash(indented)
+	c, _ := protocol.InfoHash(compact)
+	d, _ := protocol.InfoHash(torrent)
+	if a != c || a != d {
+		t.Fatalf("same content, different infohash: %x %x %x", a, c, d)
+	}
+
+	m.PieceSize = 512
+	if m.InfoHash() == a {
+		t.Fatalf("content change must change the infohash")
+	}
+}
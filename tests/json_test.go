@@ -1,15 +1,17 @@
 package tests
 
 import (
-	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
 )
 
-func TestSome(_ *testing.T) {
+func TestSome(t *testing.T) {
 	m := metainfo.Meta{FileName: "some file name))"}
-	m.Write("abc")
+	m.Write(filepath.Join(t.TempDir(), "abc"))
 	bytes, _ := json.Marshal(m)
 	fmt.Println(string(bytes))
 }
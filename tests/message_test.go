@@ -0,0 +1,39 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+func TestDecodeRejectsHugeFrame(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(protocol.MaxMessage+1))
+	buf.WriteByte(protocol.MsgPiece) // nothing else follows: must fail before reading a body
+
+	if _, err := protocol.Decode(&buf); !errors.Is(err, protocol.ErrTooLarge) {
+		t.Fatalf("want ErrTooLarge, got %v", err)
+	}
+}
+
+func TestKeepAliveRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	keepAlive, have := protocol.NewKeepAlive(), protocol.NewHave(3)
+	keepAlive.Encode(&buf)
+	have.Encode(&buf)
+	if buf.Len() != 4+9 {
+		t.Fatalf("keep-alive should be 4 zero bytes, stream is %d bytes", buf.Len())
+	}
+
+	msg, err := protocol.Decode(&buf)
+	if err != nil || msg.ID != protocol.MsgKeepAlive {
+		t.Fatalf("want keep-alive, got %+v, %v", msg, err)
+	}
+	msg, err = protocol.Decode(&buf)
+	if err != nil || msg.ID != protocol.MsgHave {
+		t.Fatalf("message after keep-alive: %+v, %v", msg, err)
+	}
+}
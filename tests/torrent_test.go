@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BitTorrentFileSharing/bittorrent/internal/bencode"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/metainfo"
+	"github.com/BitTorrentFileSharing/bittorrent/internal/protocol"
+)
+
+func TestTorrentRoundTrip(t *testing.T) {
+	h := sha1.Sum([]byte("piece"))
+	m := &metainfo.Meta{
+		FileName:   "tree",
+		FileLength: 300,
+		PieceSize:  256,
+		Hashes:     [][]byte{h[:], h[:]},
+		Files:      []metainfo.File{{Path: "a/b.txt", Length: 100}, {Path: "c", Length: 200}},
+		Comment:    "made in tests",
+	}
+	path := filepath.Join(t.TempDir(), "tree.torrent")
+	if err := m.WriteTorrent(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := metainfo.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.FileName != "tree" || loaded.FileLength != 300 || loaded.PieceSize != 256 ||
+		len(loaded.Files) != 2 || loaded.Files[0].Path != "a/b.txt" || !bytes.Equal(loaded.Hashes[1], h[:]) ||
+		loaded.Comment != "made in tests" {
+		t.Fatalf("loaded %+v", loaded)
+	}
+
+	infoHash, _ := protocol.InfoHash(path)
+	if infoHash != m.InfoHash() || infoHash != loaded.InfoHash() {
+		t.Fatalf("infohash differs between written and loaded torrent")
+	}
+}
+
+func TestTorrentInfoHashKeepsUnknownKeys(t *testing.T) {
+	h := sha1.Sum([]byte("piece"))
+	info := map[string]any{
+		"name": "f", "length": int64(10), "piece length": int64(256),
+		"pieces": string(h[:]), "private": int64(1),
+	}
+	raw, _ := bencode.Marshal(info)
+	data, _ := bencode.Marshal(map[string]any{"announce": "http://x", "info": bencode.RawMessage(raw)})
+	path := filepath.Join(t.TempDir(), "f.torrent")
+	os.WriteFile(path, data, 0o644)
+
+	m, err := metainfo.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash() != sha1.Sum(raw) {
+		t.Fatalf("infohash must cover the original info dict")
+	}
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	var ih [20]byte
+	copy(ih[:], "0123456789abcdefghij")
+	uri := metainfo.MagnetURI(ih, "my file.iso")
+
+	got, name, err := metainfo.ParseMagnet(uri)
+	if err != nil || got != ih || name != "my file.iso" {
+		t.Fatalf("parse %q: %x %q %v", uri, got, name, err)
+	}
+	// base32 form used by some clients
+	got, _, err = metainfo.ParseMagnet("magnet:?xt=urn:btih:GAYTEMZUGU3DOOBZMFRGGZDFMZTWQ2LK")
+	if err != nil || got != ih {
+		t.Fatalf("base32: %x %v", got, err)
+	}
+	if _, _, err := metainfo.ParseMagnet("magnet:?dn=x"); err == nil {
+		t.Fatalf("magnet without btih accepted")
+	}
+}
+
+func TestNameMustStayInsideDest(t *testing.T) {
+	h := sha1.Sum([]byte("piece"))
+	dir := t.TempDir()
+	for _, name := range []string{"../../x", "/etc/passwd", "a/b", `a\b`, "..", "."} {
+		m := &metainfo.Meta{FileName: name, FileLength: 10, PieceSize: 256, Hashes: [][]byte{h[:]}}
+
+		// Magnet metadata and .torrent files go through ParseInfo
+		if _, err := metainfo.ParseInfo(m.InfoBytes()); err == nil {
+			t.Errorf("info dict named %q accepted", name)
+		}
+		path := filepath.Join(dir, "m.bit")
+		m.Write(path)
+		if _, err := metainfo.Load(path); err == nil {
+			t.Errorf(".bit named %q accepted", name)
+		}
+	}
+}
+
+// A broken .bit must be refused at load, not divide by zero in verify/get/seed
+func TestBitMetaIsValidated(t *testing.T) {
+	h := sha1.Sum([]byte("piece"))
+	cases := map[string]string{
+		"zero piece size":    `{"name":"a","length":10,"piece_size":0,"hashes":[]}`,
+		"too few hashes":     `{"name":"a","length":600,"piece_size":256,"hashes":["` + b64(h[:]) + `"]}`,
+		"short hash":         `{"name":"a","length":10,"piece_size":256,"hashes":["AAAA"]}`,
+		"files don't add up": `{"name":"a","length":10,"piece_size":256,"hashes":["` + b64(h[:]) + `"],"files":[{"path":"x","length":4}]}`,
+	}
+	dir := t.TempDir()
+	for name, body := range cases {
+		path := filepath.Join(dir, "m.bit")
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := metainfo.Load(path); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func b64(b []byte) string { return base64.StdEncoding.EncodeToString(b) }